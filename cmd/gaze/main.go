@@ -11,10 +11,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/wtetsu/gaze/pkg/app"
 	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/gazer"
 	"github.com/wtetsu/gaze/pkg/logger"
 )
 
@@ -25,6 +27,8 @@ const (
 	errTimeout      = "timeout must be more than 0"
 	errColor        = "color must be 0 or 1"
 	errMaxWatchDirs = "maxWatchDirs must be more than 0"
+	errJobs         = "jobs must not be negative"
+	errOutput       = "output must be raw, prefix or grouped"
 )
 
 func main() {
@@ -52,13 +56,25 @@ func main() {
 
 	err := validate(args)
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Error("%s", err.Error())
 		return
 	}
 
-	appOptions := app.NewAppOptions(args.Timeout(), args.Restart(), args.MaxWatchDirs())
+	appOptions := app.NewAppOptions(args.Timeout(), args.Restart(), args.MaxWatchDirs()).
+		WithInitialRun(args.InitialRun()).
+		WithJobs(args.Jobs()).
+		WithKeys(args.Keys()).
+		WithClear(args.Clear()).
+		WithOutput(args.Output())
 
 	err = app.Start(args.Targets(), args.UserCommand(), args.File(), appOptions)
+	var shutdownErr *gazer.ShutdownError
+	if errors.As(err, &shutdownErr) {
+		if shutdownErr.Unstopped > 0 {
+			logger.ErrorObject(err)
+		}
+		os.Exit(shutdownErr.ExitCode())
+	}
 	if err != nil {
 		logger.ErrorObject(err)
 		os.Exit(1)
@@ -81,6 +97,10 @@ func earlyExit(args *app.Args) (bool, int) {
 		return true, 0
 	}
 
+	if args.CheckConfig() {
+		return true, checkConfig(args.File())
+	}
+
 	if len(args.Targets()) == 0 {
 		fmt.Println(usage1())
 		return true, 1
@@ -88,6 +108,24 @@ func earlyExit(args *app.Args) (bool, int) {
 	return false, 0
 }
 
+func checkConfig(file string) int {
+	checkedPaths, diagnostics := config.CheckConfig(file)
+	for _, d := range diagnostics {
+		fmt.Println(d.String())
+	}
+	if len(checkedPaths) == 0 {
+		fmt.Println("config: (default)")
+	}
+	// Warnings are printed but do not fail the check
+	if config.HasError(diagnostics) {
+		return 1
+	}
+	for _, p := range checkedPaths {
+		fmt.Println(p + ": ok")
+	}
+	return 0
+}
+
 func initLogger(args *app.Args) {
 	if args.Color() == 0 {
 		logger.Plain()
@@ -116,6 +154,12 @@ func validate(args *app.Args) error {
 	if args.MaxWatchDirs() <= 0 {
 		errorList = append(errorList, errMaxWatchDirs)
 	}
+	if args.Jobs() < 0 && args.Jobs() != app.JobsUnset {
+		errorList = append(errorList, errJobs)
+	}
+	if args.Output() != "" && !slices.Contains(config.OutputModes, args.Output()) {
+		errorList = append(errorList, errOutput)
+	}
 	if len(errorList) >= 1 {
 		return errors.New(strings.Join(errorList, "\n"))
 	}
@@ -150,11 +194,17 @@ Options:
   -c <command>    Command(s) to run when files change.
   -r              Restart mode: send SIGTERM to the running process before starting the next command.
   -t <time_ms>    Timeout (ms): send SIGTERM to the running process after the specified time.
+  -j <jobs>       Maximum number of commands running at the same time (0: unlimited).
   -f <file>       Path to a YAML configuration file.
   -v              Verbose mode: show additional information.
   -q              Quiet mode: suppress normal output.
   -y              Show the default YAML configuration.
   -h              Show help.
+  --check-config  Validate the configuration file(s) and exit (alias: gaze check).
+  --initial-run   Run matching commands once at startup.
+  --clear         Clear the screen before each run.
+  --output <mode> Output mode of commands (raw, prefix: label each line, grouped: print each run at once).
+  --keys          Enable keyboard controls (r: rerun, a: run all, c: clear, p: pause, k: kill, q: quit).
   --color <mode>  Set color mode (0: plain, 1: colorful).
   --version       Show version information.
 
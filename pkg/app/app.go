@@ -29,10 +29,38 @@ func Start(watchFiles []string, userCommand string, file string, appOptions AppO
 	if err != nil {
 		return err
 	}
+	theGazer.InitialRun(appOptions.InitialRun())
+	theGazer.Keys(appOptions.Keys())
+
+	theGazer.Jobs(resolveJobs(appOptions.Jobs(), commandConfigs.Jobs))
+
+	// --clear clears the screen unless the configuration file clears more
+	clear := commandConfigs.Clear
+	if appOptions.Clear() && clear == "" {
+		clear = config.ClearScreen
+	}
+	theGazer.Clear(clear)
+
+	output := appOptions.Output()
+	if output == "" {
+		output = commandConfigs.Output
+	}
+	theGazer.Output(output)
+	theGazer.ShutdownTimeout(commandConfigs.ShutdownTimeout)
+
 	err = theGazer.Run(commandConfigs, appOptions.Timeout(), appOptions.Restart())
 	return err
 }
 
+// resolveJobs returns the jobs of the command line option, or those of the configuration file if the option is not given.
+// An explicit -j 0 means unlimited even if the configuration file has jobs.
+func resolveJobs(optionJobs int, configJobs int) int {
+	if optionJobs == JobsUnset {
+		return configJobs
+	}
+	return optionJobs
+}
+
 func createCommandConfig(userCommand string, file string) (*config.Config, error) {
 	if userCommand != "" {
 		logger.Debug("userCommand: %s", userCommand)
@@ -52,6 +80,12 @@ func createCommandConfig(userCommand string, file string) (*config.Config, error
 
 // ParseArgs parses command arguments.
 func ParseArgs(osArgs []string, usage func()) *Args {
+	// "gaze check" is an alias of "gaze --check-config"
+	checkSubcommand := len(osArgs) >= 2 && osArgs[1] == "check"
+	if checkSubcommand {
+		osArgs = append([]string{osArgs[0]}, osArgs[2:]...)
+	}
+
 	flagSet := flag.NewFlagSet(osArgs[0], flag.ExitOnError)
 
 	flagSet.Usage = func() {
@@ -79,6 +113,12 @@ func ParseArgs(osArgs []string, usage func()) *Args {
 	debug := flagSet.Bool("debug", false, "")
 	version := flagSet.Bool("version", false, "")
 	maxWatchDirs := flagSet.Int("w", defaultMaxWatchDirs, "")
+	checkConfig := flagSet.Bool("check-config", false, "")
+	initialRun := flagSet.Bool("initial-run", false, "")
+	jobs := flagSet.Int("j", JobsUnset, "")
+	keys := flagSet.Bool("keys", false, "")
+	clear := flagSet.Bool("clear", false, "")
+	output := flagSet.String("output", "", "")
 
 	files := []string{}
 	optionStartIndex := len(osArgs)
@@ -112,6 +152,12 @@ func ParseArgs(osArgs []string, usage func()) *Args {
 		version:      *version,
 		targets:      u.List(),
 		maxWatchDirs: *maxWatchDirs,
+		checkConfig:  *checkConfig || checkSubcommand,
+		initialRun:   *initialRun,
+		jobs:         *jobs,
+		keys:         *keys,
+		clear:        *clear,
+		output:       *output,
 	}
 
 	return &args
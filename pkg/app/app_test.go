@@ -42,11 +42,9 @@ func TestCreateCommandConfigWithFile(t *testing.T) {
 
 	ymlFile := createTempFile("*.yml", yaml())
 
+	// Unknown keys are reported as errors
 	commandConfigs, err = createCommandConfig("", ymlFile)
-	if commandConfigs == nil || err != nil {
-		t.Fatal(err)
-	}
-	if len(commandConfigs.Commands) != 0 {
+	if commandConfigs != nil || err == nil {
 		t.Fatal()
 	}
 }
@@ -84,6 +82,38 @@ func TestEndTopEndError(t *testing.T) {
 	}
 }
 
+func TestAppOptions(t *testing.T) {
+	appOptions := NewAppOptions(100, true, 10)
+	if appOptions.Timeout() != 100 || !appOptions.Restart() || appOptions.MaxWatchDirs() != 10 || appOptions.InitialRun() {
+		t.Fatal()
+	}
+	if !appOptions.WithInitialRun(true).InitialRun() || appOptions.InitialRun() {
+		t.Fatal()
+	}
+	if appOptions.WithJobs(2).Jobs() != 2 || appOptions.Jobs() != JobsUnset {
+		t.Fatal()
+	}
+	if !appOptions.WithKeys(true).Keys() || appOptions.Keys() {
+		t.Fatal()
+	}
+	if !appOptions.WithClear(true).Clear() || appOptions.Clear() {
+		t.Fatal()
+	}
+	if appOptions.WithOutput("prefix").Output() != "prefix" || appOptions.Output() != "" {
+		t.Fatal()
+	}
+}
+
+func TestResolveJobs(t *testing.T) {
+	if resolveJobs(JobsUnset, 4) != 4 || resolveJobs(2, 4) != 2 {
+		t.Fatal()
+	}
+	// -j 0 is unlimited even if the configuration file has jobs
+	if resolveJobs(0, 4) != 0 {
+		t.Fatal()
+	}
+}
+
 func TestParseArgs(t *testing.T) {
 	usage := func() {}
 	if !ParseArgs([]string{"", "-h"}, usage).Help() {
@@ -122,6 +152,27 @@ func TestParseArgs(t *testing.T) {
 	if !ParseArgs([]string{"", "--version"}, usage).Version() {
 		t.Fatal()
 	}
+	if !ParseArgs([]string{"", "--check-config"}, usage).CheckConfig() {
+		t.Fatal()
+	}
+	if !ParseArgs([]string{"", "--initial-run"}, usage).InitialRun() {
+		t.Fatal()
+	}
+	if ParseArgs([]string{"", "-j", "4"}, usage).Jobs() != 4 || ParseArgs([]string{"", "-j", "0"}, usage).Jobs() != 0 || ParseArgs([]string{""}, usage).Jobs() != JobsUnset {
+		t.Fatal()
+	}
+	if !ParseArgs([]string{"", "--keys"}, usage).Keys() || ParseArgs([]string{""}, usage).Keys() {
+		t.Fatal()
+	}
+	if !ParseArgs([]string{"", "--clear"}, usage).Clear() || ParseArgs([]string{""}, usage).Clear() {
+		t.Fatal()
+	}
+	if ParseArgs([]string{"", "--output", "grouped"}, usage).Output() != "grouped" || ParseArgs([]string{""}, usage).Output() != "" {
+		t.Fatal()
+	}
+	if a := ParseArgs([]string{"", "check", "-f", "abc.yml"}, usage); !a.CheckConfig() || a.File() != "abc.yml" || len(a.Targets()) != 0 {
+		t.Fatal()
+	}
 	if !reflect.DeepEqual(ParseArgs([]string{"", "a.txt", "b.txt", "c.txt"}, usage).Targets(), []string{"a.txt", "b.txt", "c.txt"}) {
 		t.Fatal()
 	}
@@ -155,6 +206,7 @@ func touch(fileName string) {
 
 func yaml() string {
 	return `#
+extends: none
 commands:
 - ext: .py
   run: python "{{file}}"
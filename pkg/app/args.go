@@ -21,6 +21,12 @@ type Args struct {
 	version      bool
 	targets      []string
 	maxWatchDirs int
+	checkConfig  bool
+	initialRun   bool
+	jobs         int
+	keys         bool
+	clear        bool
+	output       string
 }
 
 // Help returns a.help
@@ -87,3 +93,33 @@ func (a *Args) Targets() []string {
 func (a *Args) MaxWatchDirs() int {
 	return a.maxWatchDirs
 }
+
+// CheckConfig returns a.checkConfig
+func (a *Args) CheckConfig() bool {
+	return a.checkConfig
+}
+
+// InitialRun returns a.initialRun
+func (a *Args) InitialRun() bool {
+	return a.initialRun
+}
+
+// Jobs returns a.jobs
+func (a *Args) Jobs() int {
+	return a.jobs
+}
+
+// Keys returns a.keys
+func (a *Args) Keys() bool {
+	return a.keys
+}
+
+// Clear returns a.clear
+func (a *Args) Clear() bool {
+	return a.clear
+}
+
+// Output returns a.output
+func (a *Args) Output() string {
+	return a.output
+}
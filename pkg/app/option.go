@@ -6,10 +6,18 @@
 
 package app
 
+// JobsUnset is the jobs of AppOptions when -j is not given. The jobs of the configuration file are used.
+const JobsUnset = -1
+
 type AppOptions struct {
 	timeout      int64
 	restart      bool
 	maxWatchDirs int
+	initialRun   bool
+	jobs         int
+	keys         bool
+	clear        bool
+	output       string
 }
 
 func NewAppOptions(timeout int64, restart bool, maxWatchDirs int) AppOptions {
@@ -17,6 +25,7 @@ func NewAppOptions(timeout int64, restart bool, maxWatchDirs int) AppOptions {
 		timeout:      timeout,
 		restart:      restart,
 		maxWatchDirs: maxWatchDirs,
+		jobs:         JobsUnset,
 	}
 }
 
@@ -31,3 +40,53 @@ func (a AppOptions) Restart() bool {
 func (a AppOptions) MaxWatchDirs() int {
 	return a.maxWatchDirs
 }
+
+func (a AppOptions) InitialRun() bool {
+	return a.initialRun
+}
+
+// WithInitialRun returns a copy with initialRun set
+func (a AppOptions) WithInitialRun(initialRun bool) AppOptions {
+	a.initialRun = initialRun
+	return a
+}
+
+func (a AppOptions) Jobs() int {
+	return a.jobs
+}
+
+// WithJobs returns a copy with jobs set
+func (a AppOptions) WithJobs(jobs int) AppOptions {
+	a.jobs = jobs
+	return a
+}
+
+func (a AppOptions) Keys() bool {
+	return a.keys
+}
+
+// WithKeys returns a copy with keys set
+func (a AppOptions) WithKeys(keys bool) AppOptions {
+	a.keys = keys
+	return a
+}
+
+func (a AppOptions) Clear() bool {
+	return a.clear
+}
+
+// WithClear returns a copy with clear set
+func (a AppOptions) WithClear(clear bool) AppOptions {
+	a.clear = clear
+	return a
+}
+
+func (a AppOptions) Output() string {
+	return a.output
+}
+
+// WithOutput returns a copy with output set
+func (a AppOptions) WithOutput(output string) AppOptions {
+	a.output = output
+	return a
+}
@@ -0,0 +1,414 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/cbroglie/mustache"
+	"gopkg.in/yaml.v3"
+)
+
+// Diagnostic represents a problem found in a configuration file.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+	Warning bool
+}
+
+func (d Diagnostic) String() string {
+	level := "error"
+	if d.Warning {
+		level = "warning"
+	}
+	if d.Line <= 0 {
+		return fmt.Sprintf("%s: %s: %s", d.File, level, d.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, level, d.Message)
+}
+
+// CheckConfig validates the configuration files that would be loaded.
+// If configPath is empty, the preferred configuration files are checked.
+func CheckConfig(configPath string) ([]string, []Diagnostic) {
+	configPaths := preferredConfigPaths(homeDirPath(), workingDirPath())
+	if configPath != "" {
+		configPaths = append([]string{configPath}, configPaths...)
+	}
+
+	var checkedPaths []string
+	var diagnostics []Diagnostic
+	checked := map[string]struct{}{}
+	for _, p := range configPaths {
+		absPath, _ := filepath.Abs(p)
+		if _, ok := checked[absPath]; ok {
+			continue
+		}
+		checked[absPath] = struct{}{}
+
+		checkedPaths = append(checkedPaths, p)
+		bytes, err := os.ReadFile(p)
+		if err != nil {
+			diagnostics = append(diagnostics, Diagnostic{File: p, Message: err.Error()})
+			break
+		}
+		diagnostics = append(diagnostics, checkConfigBytes(p, bytes)...)
+
+		rawConfig, err := parseRawConfigFromBytes(bytes)
+		if err != nil || !rawConfig.inherits() {
+			break
+		}
+	}
+	return checkedPaths, diagnostics
+}
+
+// HasError returns true if diagnostics contain at least one error.
+func HasError(diagnostics []Diagnostic) bool {
+	for _, d := range diagnostics {
+		if !d.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+func diagnosticsError(diagnostics []Diagnostic) error {
+	var lines []string
+	for _, d := range diagnostics {
+		if !d.Warning {
+			lines = append(lines, d.String())
+		}
+	}
+	return errors.New("invalid configuration:\n" + strings.Join(lines, "\n"))
+}
+
+// checkConfigBytes validates a configuration and returns all problems with their positions.
+func checkConfigBytes(fileName string, fileBuffer []byte) []Diagnostic {
+	c := &checker{fileName: fileName}
+
+	var root yaml.Node
+	err := yaml.Unmarshal(fileBuffer, &root)
+	if err != nil {
+		c.addSyntaxError(err)
+		return c.diagnostics
+	}
+	if len(root.Content) == 0 {
+		c.warnAt(nil, "empty configuration")
+		return c.diagnostics
+	}
+
+	doc := root.Content[0]
+	c.checkNode(doc, reflect.TypeOf(rawConfig{}))
+
+	commands := findValue(doc, "commands")
+	if commands != nil && commands.Kind == yaml.SequenceNode {
+		for i, commandNode := range commands.Content {
+			if commandNode.Kind == yaml.MappingNode {
+				c.checkCommand(commandNode, i)
+			}
+		}
+	}
+
+	extends := findValue(doc, "extends")
+	if !isEmpty(extends) && extends.Value != "none" {
+		c.errorAt(extends, "extends must be \"none\"")
+	}
+
+	match := findValue(doc, "match")
+	if !isEmpty(match) && match.Value != "first" && match.Value != "all" {
+		c.errorAt(match, "match must be \"first\" or \"all\"")
+	}
+
+	clear := findValue(doc, "clear")
+	if !isEmpty(clear) && clear.Value != "false" && toClear(clear.Value) == "" {
+		c.errorAt(clear, "clear must be true, false, screen or scrollback")
+	}
+
+	output := findValue(doc, "output")
+	if !isEmpty(output) && !slices.Contains(OutputModes, output.Value) {
+		c.errorAt(output, "output must be one of %s", strings.Join(OutputModes, ", "))
+	}
+
+	for _, key := range []string{"jobs", "output_keep", "output_keep_days", "shutdown_timeout_ms"} {
+		value := findValue(doc, key)
+		var intValue int
+		if value != nil && value.Decode(&intValue) == nil && intValue < 0 {
+			c.errorAt(value, "%s must not be negative", key)
+		}
+	}
+	c.checkTemplate(findValue(doc, "output_file"))
+
+	log := findValue(doc, "log")
+	if log != nil {
+		for _, key := range []string{"start", "end", "separator"} {
+			c.checkTemplate(findValue(log, key))
+		}
+	}
+
+	sort.SliceStable(c.diagnostics, func(i, j int) bool {
+		a, b := c.diagnostics[i], c.diagnostics[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return c.diagnostics
+}
+
+type checker struct {
+	fileName    string
+	diagnostics []Diagnostic
+}
+
+func (c *checker) errorAt(node *yaml.Node, format string, a ...interface{}) {
+	c.add(node, false, format, a...)
+}
+
+func (c *checker) warnAt(node *yaml.Node, format string, a ...interface{}) {
+	c.add(node, true, format, a...)
+}
+
+func (c *checker) add(node *yaml.Node, warning bool, format string, a ...interface{}) {
+	d := Diagnostic{File: c.fileName, Message: fmt.Sprintf(format, a...), Warning: warning}
+	if node != nil {
+		d.Line = node.Line
+		d.Column = node.Column
+	}
+	c.diagnostics = append(c.diagnostics, d)
+}
+
+var syntaxErrorLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+func (c *checker) addSyntaxError(err error) {
+	d := Diagnostic{File: c.fileName, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+	m := syntaxErrorLine.FindStringSubmatch(err.Error())
+	if m != nil {
+		d.Line, _ = strconv.Atoi(m[1])
+		d.Column = 1
+		d.Message = strings.TrimPrefix(err.Error(), m[0])
+	}
+	c.diagnostics = append(c.diagnostics, d)
+}
+
+// checkNode verifies that node can be deserialized into t and has no unknown keys.
+func (c *checker) checkNode(node *yaml.Node, t reflect.Type) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+
+	if t.Kind() == reflect.Struct && !reflect.PointerTo(t).Implements(unmarshalerType) {
+		if node.Kind != yaml.MappingNode {
+			c.errorAt(node, "expected a mapping")
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode := node.Content[i]
+			valueNode := node.Content[i+1]
+			field, ok := findField(t, keyNode.Value)
+			if !ok {
+				c.errorAt(keyNode, "unknown key %q", keyNode.Value)
+				continue
+			}
+			c.checkNode(valueNode, field.Type)
+		}
+		return
+	}
+
+	if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct {
+		if node.Kind != yaml.SequenceNode {
+			c.errorAt(node, "expected a list")
+			return
+		}
+		for _, item := range node.Content {
+			c.checkNode(item, t.Elem())
+		}
+		return
+	}
+
+	err := node.Decode(reflect.New(t).Interface())
+	if err != nil {
+		c.errorAt(node, "%s", decodeErrorMessage(err))
+	}
+}
+
+func (c *checker) checkCommand(node *yaml.Node, index int) {
+	cmd := findValue(node, "cmd")
+	ext := findValue(node, "ext")
+	re := findValue(node, "re")
+
+	steps := findValue(node, "steps")
+	if isEmpty(cmd) && isEmpty(steps) {
+		c.errorAt(node, "commands[%d]: cmd is empty", index)
+	} else if !isEmpty(cmd) && !isEmpty(steps) {
+		c.errorAt(steps, "commands[%d]: cmd and steps cannot be used together", index)
+	} else {
+		c.checkTemplate(cmd)
+	}
+	if steps != nil && steps.Kind == yaml.SequenceNode {
+		for i, stepNode := range steps.Content {
+			run := findValue(stepNode, "run")
+			if isEmpty(run) {
+				c.errorAt(stepNode, "commands[%d].steps[%d]: run is empty", index, i)
+			}
+			c.checkTemplate(run)
+		}
+	}
+
+	glob := findValue(node, "glob")
+	if isEmpty(ext) && isEmpty(re) && isEmpty(glob) {
+		c.warnAt(node, "commands[%d]: ext, re and glob are all empty; this command never matches", index)
+	}
+	c.checkGlobs(glob, index)
+	c.checkGlobs(findValue(node, "exclude"), index)
+
+	if !isEmpty(re) {
+		_, err := regexp.Compile(re.Value)
+		if err != nil {
+			c.errorAt(re, "commands[%d]: %s", index, err.Error())
+		}
+	}
+
+	queue := findValue(node, "queue")
+	if !isEmpty(queue) && !slices.Contains([]string{QueueCoalesce, QueueAll, QueueDrop, QueueCancel}, queue.Value) {
+		c.errorAt(queue, "commands[%d]: queue must be one of coalesce, all, drop and cancel", index)
+	}
+
+	stopSignal := findValue(node, "stop_signal")
+	if !isEmpty(stopSignal) && !slices.Contains(StopSignals, stopSignal.Value) {
+		c.errorAt(stopSignal, "commands[%d]: stop_signal must be one of %s", index, strings.Join(StopSignals, ", "))
+	}
+
+	output := findValue(node, "output")
+	if !isEmpty(output) && !slices.Contains(OutputModes, output.Value) {
+		c.errorAt(output, "commands[%d]: output must be one of %s", index, strings.Join(OutputModes, ", "))
+	}
+
+	for _, key := range []string{"timeout", "batch", "cancel_after", "stop_grace_ms", "output_keep", "output_keep_days"} {
+		value := findValue(node, key)
+		var intValue int64
+		if value != nil && value.Decode(&intValue) == nil && intValue < 0 {
+			c.errorAt(value, "commands[%d]: %s must not be negative", index, key)
+		}
+	}
+
+	c.checkTemplate(findValue(node, "cwd"))
+	c.checkTemplate(findValue(node, "output_file"))
+
+	script := findValue(node, "script")
+	if !isEmpty(script) && script.Value == "true" && !isEmpty(steps) {
+		c.errorAt(script, "commands[%d]: script and steps cannot be used together", index)
+	}
+	interpreter := findValue(node, "interpreter")
+	if !isEmpty(interpreter) && (isEmpty(script) || script.Value != "true") {
+		c.warnAt(interpreter, "commands[%d]: interpreter is ignored without script: true", index)
+	}
+
+	pty := findValue(node, "pty")
+	stdin := findValue(node, "stdin")
+	if !isEmpty(pty) && pty.Value == "true" && !isEmpty(stdin) && stdin.Value == "true" {
+		c.warnAt(pty, "commands[%d]: pty is ignored with stdin: true", index)
+	}
+
+	retry := findValue(node, "retry")
+	for _, key := range []string{"count", "delay_ms", "backoff"} {
+		value := findValue(retry, key)
+		var floatValue float64
+		if value != nil && value.Decode(&floatValue) == nil && floatValue < 0 {
+			c.errorAt(value, "commands[%d]: retry.%s must not be negative", index, key)
+		}
+	}
+}
+
+func (c *checker) checkGlobs(node *yaml.Node, index int) {
+	if isEmpty(node) {
+		return
+	}
+	var patterns stringList
+	if node.Decode(&patterns) != nil {
+		return
+	}
+	for _, p := range patterns {
+		_, err := doublestar.Match(p, p)
+		if err != nil {
+			c.errorAt(node, "commands[%d]: invalid glob pattern %q", index, p)
+		}
+	}
+}
+
+func (c *checker) checkTemplate(node *yaml.Node) {
+	if isEmpty(node) {
+		return
+	}
+	_, err := mustache.ParseStringRaw(node.Value, true)
+	if err != nil {
+		c.errorAt(node, "invalid template: %s", err.Error())
+	}
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// findField returns the struct field that yaml.v3 would deserialize key into.
+func findField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if name == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func findValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func isEmpty(node *yaml.Node) bool {
+	if node == nil {
+		return true
+	}
+	if node.Kind == yaml.SequenceNode {
+		for _, item := range node.Content {
+			if !isEmpty(item) {
+				return false
+			}
+		}
+		return true
+	}
+	return node.Kind == yaml.ScalarNode && node.Value == ""
+}
+
+var decodeErrorPrefix = regexp.MustCompile(`^yaml: unmarshal errors:\n\s*line \d+: `)
+
+func decodeErrorMessage(err error) string {
+	return decodeErrorPrefix.ReplaceAllString(err.Error(), "")
+}
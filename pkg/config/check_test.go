@@ -0,0 +1,188 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigBytes(t *testing.T) {
+	yml := `commands:
+  - ext: .py
+    run: python "{{file}}"
+  - re: "(["
+    cmd: echo
+  - cmd: echo {{file
+    ext: .txt
+  - cmd: noMatch
+log:
+  start: "{{command"
+  foo: bar
+`
+	diagnostics := checkConfigBytes("gaze.yml", []byte(yml))
+
+	expected := []string{
+		`gaze.yml:2:5: error: commands[0]: cmd is empty`,
+		`gaze.yml:3:5: error: unknown key "run"`,
+		`gaze.yml:4:9: error: commands[1]: error parsing regexp: missing closing ]: ` + "`[`",
+		`gaze.yml:6:10: error: invalid template: line 1: unmatched open tag`,
+		`gaze.yml:8:5: warning: commands[3]: ext, re and glob are all empty; this command never matches`,
+		`gaze.yml:10:10: error: invalid template: line 1: unmatched open tag`,
+		`gaze.yml:11:3: error: unknown key "foo"`,
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("expected %d diagnostics, got %v", len(expected), diagnostics)
+	}
+	for i, d := range diagnostics {
+		if d.String() != expected[i] {
+			t.Errorf("expected %q but got %q", expected[i], d.String())
+		}
+	}
+	if !HasError(diagnostics) {
+		t.Fatal()
+	}
+}
+
+func TestCheckConfigBytesTypes(t *testing.T) {
+	yml := `commands: abc
+log:
+  - start
+inherit: maybe
+`
+	diagnostics := checkConfigBytes("gaze.yml", []byte(yml))
+	if len(diagnostics) != 3 {
+		t.Fatalf("expected 3 diagnostics, got %v", diagnostics)
+	}
+	if diagnostics[0].Line != 1 || diagnostics[0].Message != "expected a list" {
+		t.Errorf("unexpected diagnostic: %s", diagnostics[0])
+	}
+	if diagnostics[1].Line != 3 || diagnostics[1].Message != "expected a mapping" {
+		t.Errorf("unexpected diagnostic: %s", diagnostics[1])
+	}
+	if diagnostics[2].Line != 4 || !strings.Contains(diagnostics[2].Message, "cannot unmarshal") {
+		t.Errorf("unexpected diagnostic: %s", diagnostics[2])
+	}
+}
+
+func TestCheckConfigBytesValid(t *testing.T) {
+	diagnostics := checkConfigBytes("default.yml", []byte(Default()))
+	if len(diagnostics) != 0 {
+		t.Fatalf("expected no diagnostics, got %v", diagnostics)
+	}
+
+	diagnostics = checkConfigBytes("gaze.yml", []byte("commands:\n- ext:\n  cmd: abc\n"))
+	if len(diagnostics) != 1 || !diagnostics[0].Warning || HasError(diagnostics) {
+		t.Fatalf("expected a warning, got %v", diagnostics)
+	}
+
+	diagnostics = checkConfigBytes("gaze.yml", []byte(""))
+	if len(diagnostics) != 1 || !diagnostics[0].Warning {
+		t.Fatalf("expected a warning, got %v", diagnostics)
+	}
+
+	diagnostics = checkConfigBytes("gaze.yml", []byte("a: b\n c: [\n"))
+	if len(diagnostics) != 1 || diagnostics[0].String() != "gaze.yml:2:1: error: mapping values are not allowed in this context" {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	valid := createTempFile("*.yml", "extends: none\ncommands:\n- ext: .py\n  cmd: python\n")
+	defer os.Remove(valid)
+
+	checkedPaths, diagnostics := CheckConfig(valid)
+	if len(checkedPaths) != 1 || checkedPaths[0] != valid || len(diagnostics) != 0 {
+		t.Fatalf("unexpected result: %v, %v", checkedPaths, diagnostics)
+	}
+
+	_, diagnostics = CheckConfig("___.yml")
+	if len(diagnostics) != 1 || !HasError(diagnostics) {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+}
+
+func TestCheckConfigProjectFile(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, ".git"), 0755)
+	os.WriteFile(filepath.Join(dir, "gaze.yml"), []byte("commands:\n- ext: .py\n  run: python\n"), 0644)
+	t.Chdir(dir)
+
+	checkedPaths, diagnostics := CheckConfig("gaze.yml")
+	if checkedPaths[0] != "gaze.yml" {
+		t.Fatalf("unexpected paths: %v", checkedPaths)
+	}
+	count := 0
+	for _, d := range diagnostics {
+		if d.File == "gaze.yml" || strings.HasSuffix(d.File, "/gaze.yml") {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Fatalf("gaze.yml must be checked once: %v, %v", checkedPaths, diagnostics)
+	}
+}
+
+func TestCheckConfigBytesExtends(t *testing.T) {
+	expectDiagnostics(t, "extends: none\ncommands: []\n")
+	expectDiagnostics(t, "extends: base.yml\ncommands: []\n", `gaze.yml:1:10: error: extends must be "none"`)
+}
+
+func TestLoadConfigFromFileWithErrors(t *testing.T) {
+	invalid := createTempFile("*.yml", "commands:\n- ext: .py\n  run: python\n")
+	defer os.Remove(invalid)
+
+	cfg, err := LoadConfigFromFile(invalid)
+	if err == nil || cfg != nil {
+		t.Fatal("expected an error for an invalid configuration")
+	}
+	if !strings.Contains(err.Error(), `:3:3: error: unknown key "run"`) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestCheckConfigBytesQueue(t *testing.T) {
+	yml := `commands:
+  - ext: .py
+    cmd: python "{{file}}"
+    queue: all
+  - ext: .rb
+    cmd: ruby "{{file}}"
+    queue: later
+    cancel_after: -1
+`
+	diagnostics := checkConfigBytes("gaze.yml", []byte(yml))
+
+	expected := []string{
+		`gaze.yml:7:12: error: commands[1]: queue must be one of coalesce, all, drop and cancel`,
+		`gaze.yml:8:19: error: commands[1]: cancel_after must not be negative`,
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("expected %d diagnostics, got %v", len(expected), diagnostics)
+	}
+	for i, d := range diagnostics {
+		if d.String() != expected[i] {
+			t.Errorf("expected %q but got %q", expected[i], d.String())
+		}
+	}
+}
+
+// expectDiagnostics checks yml as gaze.yml and fails unless the diagnostics are exactly expected.
+func expectDiagnostics(t *testing.T, yml string, expected ...string) {
+	t.Helper()
+	diagnostics := checkConfigBytes("gaze.yml", []byte(yml))
+	var actual []string
+	for _, d := range diagnostics {
+		actual = append(actual, d.String())
+	}
+	if !slices.Equal(actual, expected) {
+		t.Fatalf("unexpected diagnostics: %q", actual)
+	}
+}
@@ -8,12 +8,18 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/bmatcuk/doublestar"
 	"github.com/cbroglie/mustache"
 	"github.com/wtetsu/gaze/pkg/gutil"
 	"github.com/wtetsu/gaze/pkg/logger"
@@ -22,39 +28,246 @@ import (
 
 // For deserialize
 type rawConfig struct {
-	Commands []rawCommand
-	Log      *rawLog
+	Commands          []rawCommand
+	Log               *rawLog
+	Extends           string
+	Inherit           *bool
+	Match             string
+	Jobs              int
+	Env               map[string]string
+	EnvFile           stringList `yaml:"env_file"`
+	ExpandEnv         *bool      `yaml:"expand_env"`
+	Clear             string
+	Output            string
+	Pty               *bool
+	OutputDir         string `yaml:"output_dir"`
+	OutputFile        string `yaml:"output_file"`
+	OutputKeep        int    `yaml:"output_keep"`
+	OutputKeepDays    int    `yaml:"output_keep_days"`
+	ShutdownTimeoutMs int64  `yaml:"shutdown_timeout_ms"`
 }
 
 // For deserialize
 type rawCommand struct {
-	Ext string
-	Cmd string
-	Re  string
+	Ext            stringList
+	Cmd            string
+	Re             string
+	Glob           stringList
+	Exclude        stringList
+	Timeout        int64
+	Restart        *bool
+	Cwd            string
+	Env            map[string]string
+	Continue       bool
+	Batch          int64
+	Queue          string
+	CancelAfter    int64 `yaml:"cancel_after"`
+	Group          string
+	Steps          []rawStep
+	Retry          *rawRetry
+	StopSignal     string `yaml:"stop_signal"`
+	StopGraceMs    int64  `yaml:"stop_grace_ms"`
+	Shell          string
+	Script         bool
+	Interpreter    string
+	EnvFile        stringList `yaml:"env_file"`
+	ExpandEnv      *bool      `yaml:"expand_env"`
+	Stdin          bool
+	Output         string
+	Pty            *bool
+	OutputDir      string `yaml:"output_dir"`
+	OutputFile     string `yaml:"output_file"`
+	OutputKeep     int    `yaml:"output_keep"`
+	OutputKeepDays int    `yaml:"output_keep_days"`
+}
+
+// For deserialize
+type rawRetry struct {
+	Count   int
+	DelayMs int64 `yaml:"delay_ms"`
+	Backoff float64
+}
+
+// For deserialize
+type rawStep struct {
+	Run             string
+	ContinueOnError bool `yaml:"continue_on_error"`
+	Always          bool
+}
+
+// For deserialize. Accepts both a string and a list of strings
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	var list []string
+	err := value.Decode(&list)
+	if err != nil {
+		return err
+	}
+	*l = list
+	return nil
 }
 
 // For deserialize
 type rawLog struct {
-	Start string
-	End   string
+	Start     string
+	End       string
+	Separator string
 }
 
 // Config represents Gaze configuration
 type Config struct {
-	Commands []Command
-	Log      *Log
+	Commands        []Command
+	Log             *Log
+	MatchAll        bool   // Run all matching commands instead of the first one
+	Jobs            int    // Maximum number of commands running at the same time. 0 means unlimited
+	Clear           string // Clear the terminal before each run. See ClearScreen and ClearScrollback. Empty means no clear
+	Output          string // Output mode of commands. See OutputRaw, etc. Empty means OutputRaw
+	ShutdownTimeout int64  // Time(ms) to wait for the commands to exit when Gaze stops. 0 means 10 seconds
 }
 
 // Command represents Gaze configuration
 type Command struct {
-	Ext string
-	Cmd string
-	re  *regexp.Regexp
+	Ext         []string // Extensions. Any of them matches
+	Glob        []string // Glob patterns (doublestar). Any of them matches
+	Exclude     []string // Glob patterns (doublestar) of files that never match
+	Cmd         string
+	Timeout     int64             // Timeout(ms). 0 means the value of the -t option
+	Restart     *bool             // nil means the value of the -r option
+	Cwd         string            // Working directory template. Empty means the current directory
+	Env         map[string]string // Additional environment variables
+	Continue    bool              // Look for more matching commands after this one
+	Batch       int64             // Collection window(ms). Events within it run the command once with {{files}}
+	Queue       string            // Queue policy while the command is running. See QueueCoalesce, etc.
+	CancelAfter int64             // With QueueCancel, a running command older than this(ms) is restarted
+	Group       string            // Commands in the same group run one at a time
+	Steps       []Step            // Used instead of Cmd to set a failure policy per step
+	Retry       Retry             // Retry policy of a failed command
+	StopSignal  string            // Signal to stop the command (e.g. SIGINT). SIGTERM if empty
+	StopGraceMs int64             // SIGKILL is sent if the command does not exit within this period(ms) after StopSignal
+	Shell       string            // Shell to run the command with "<shell> -c" (e.g. sh, bash). ShellDefault means $SHELL. Empty means direct execution
+	Script      bool              // Run the whole Cmd as one script file instead of line by line
+	Interpreter string            // Interpreter of the script (e.g. "bash -euo pipefail", python). Shell or sh if empty
+	EnvFile     []string          // Dotenv files loaded before Env
+	ExpandEnv   bool              // Expand $VAR and ${VAR:-default} in Cmd and Env
+	Stdin       bool              // Connect stdin of Gaze to the command
+	Output      string            // Output mode. See OutputRaw, etc. Empty means the global output mode
+	Pty         bool              // Run the command under pseudo-terminals to keep colors (Linux only)
+	OutputDir   string            // Directory to keep the output of each run. Empty means the output is not kept
+	OutputFile  string            // File name template of the output of a run. See DefaultOutputFile
+	OutputKeep  int               // Maximum number of output files kept per command. 0 means unlimited
+	// Output files older than this(days) are removed. 0 means unlimited
+	OutputKeepDays int
+	re             *regexp.Regexp
+}
+
+// Step represents a step of a command.
+type Step struct {
+	Run             string // Command template
+	ContinueOnError bool   // Following steps run even if this step fails
+	Always          bool   // Runs even if a previous step failed
+}
+
+// Retry represents how a failed command is retried.
+type Retry struct {
+	Count   int     // Maximum number of retries. 0 means no retry
+	DelayMs int64   // Delay(ms) before the first retry
+	Backoff float64 // The delay is multiplied by this after each retry. 0 means a constant delay
+}
+
+func toSteps(rawSteps []rawStep) []Step {
+	if len(rawSteps) == 0 {
+		return nil
+	}
+	steps := make([]Step, len(rawSteps))
+	for i, s := range rawSteps {
+		steps[i] = Step{Run: s.Run, ContinueOnError: s.ContinueOnError, Always: s.Always}
+	}
+	return steps
+}
+
+// Template returns the command template: Cmd, or the runs of Steps separated by newlines.
+func (c *Command) Template() string {
+	if len(c.Steps) == 0 {
+		return c.Cmd
+	}
+	runs := make([]string, len(c.Steps))
+	for i, s := range c.Steps {
+		runs[i] = s.Run
+	}
+	return strings.Join(runs, "\n")
+}
+
+// ShellDefault is the value of Command.Shell to use $SHELL. It is set by "shell: true".
+const ShellDefault = "true"
+
+// StopSignals are the signals available as stop_signal.
+var StopSignals = []string{"SIGTERM", "SIGINT", "SIGHUP", "SIGQUIT", "SIGKILL"}
+
+// Queue policies. They decide what happens to events while the same command is running.
+const (
+	QueueCoalesce = "coalesce" // Keep only the latest event (default)
+	QueueAll      = "all"      // Keep every distinct file in FIFO order
+	QueueDrop     = "drop"     // Ignore events
+	QueueCancel   = "cancel"   // Restart the command if it has run longer than CancelAfter; otherwise coalesce
+)
+
+// Clear modes
+const (
+	ClearScreen     = "screen"     // Clear the screen
+	ClearScrollback = "scrollback" // Clear the screen and the scrollback
+)
+
+// Output modes. They decide how the output of commands is written.
+const (
+	OutputRaw     = "raw"     // Write the output as it is
+	OutputPrefix  = "prefix"  // Label each line with the file or the command
+	OutputGrouped = "grouped" // Buffer the output of a run and write it when the run finishes
+)
+
+// OutputModes are the values available as output.
+var OutputModes = []string{OutputRaw, OutputPrefix, OutputGrouped}
+
+// DefaultOutputFile is the file name template of the output of a run in OutputDir.
+const DefaultOutputFile = "{{YYYY}}{{MM}}{{DD}}-{{HH}}{{mm}}{{ss}}-{{SSS}}-{{base}}.log"
+
+var nonKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Key returns a name of the command usable as a file name, e.g. "python_file-1a2b3c4d".
+// It is made from the command template and stays the same while the template is not changed.
+func (c *Command) Key() string {
+	template := c.Template()
+	slug := strings.Trim(nonKeyChars.ReplaceAllString(template, "_"), "_.")
+	if len(slug) > 32 {
+		slug = strings.TrimRight(slug[:32], "_.")
+	}
+	h := fnv.New32a()
+	h.Write([]byte(template))
+	if slug == "" {
+		return fmt.Sprintf("%08x", h.Sum32())
+	}
+	return fmt.Sprintf("%s-%08x", slug, h.Sum32())
+}
+
+// toClear returns the clear mode of a value of clear. "true" means ClearScreen.
+func toClear(value string) string {
+	switch value {
+	case "true", ClearScreen:
+		return ClearScreen
+	case ClearScrollback:
+		return ClearScrollback
+	}
+	return ""
 }
 
 type Log struct {
-	start *mustache.Template
-	end   *mustache.Template
+	start     *mustache.Template
+	end       *mustache.Template
+	separator *mustache.Template
 }
 
 // New returns a new Config.
@@ -62,40 +275,195 @@ func NewWithFixedCommand(command string) (*Config, error) {
 	if command == "" {
 		return nil, errors.New("empty command")
 	}
+	return newWithFixedCommand(command, homeDirPath(), workingDirPath())
+}
+
+// newWithFixedCommand replaces the commands of the loaded configuration with the fixed command.
+// Global settings (jobs, env, output, ...) are kept.
+func newWithFixedCommand(command string, home string, cwd string) (*Config, error) {
 	fixedCommand := rawCommand{Cmd: command, Re: "."}
-	loadedRawConfig, err := loadPreferredRawConfig(homeDirPath())
+	loadedRawConfig, err := loadPreferredRawConfig(home, cwd)
 	if err != nil {
 		return nil, err
 	}
 
-	config := rawConfig{Commands: []rawCommand{fixedCommand}, Log: loadedRawConfig.Log}
+	config := *loadedRawConfig
+	config.Commands = []rawCommand{fixedCommand}
 	return toConfig(&config), nil
 }
 
-// LoadPreferredConfig loads a configuration file.
-// Priority: default < ~/.gaze.yml < ~/.config/gaze/gaze.yml < -f option)
+// LoadPreferredConfig loads configuration files and merges them.
+// Priority: default < ~/.gaze.yml < ~/.config/gaze/gaze.yml < project .gaze.yml < -f option)
 func LoadPreferredConfig() (*Config, error) {
-	rawConfig, err := loadPreferredRawConfig(homeDirPath())
+	rawConfig, err := loadPreferredRawConfig(homeDirPath(), workingDirPath())
 	if err != nil {
 		return nil, err
 	}
 	return toConfig(rawConfig), nil
 }
 
-func loadPreferredRawConfig(home string) (*rawConfig, error) {
-	configPath := searchConfigPath(home)
+func loadPreferredRawConfig(home string, cwd string) (*rawConfig, error) {
+	return loadMergedRawConfig(preferredConfigPaths(home, cwd))
+}
+
+// preferredConfigPaths returns existing configuration files, higher priority first.
+func preferredConfigPaths(home string, cwd string) []string {
+	var configPaths []string
+	for _, p := range []string{searchProjectConfigPath(cwd, home), searchConfigPath(home)} {
+		if p != "" {
+			configPaths = append(configPaths, p)
+		}
+	}
+	return configPaths
+}
+
+// loadMergedRawConfig merges configuration files (higher priority first) and the default configuration.
+// A file with "extends: none" or "inherit: false" stops the lower layers from being merged.
+func loadMergedRawConfig(configPaths []string) (*rawConfig, error) {
+	merged := &rawConfig{}
+	loaded := map[string]struct{}{}
+	for _, configPath := range configPaths {
+		absPath, _ := filepath.Abs(configPath)
+		if _, ok := loaded[absPath]; ok {
+			continue
+		}
+		loaded[absPath] = struct{}{}
 
-	if configPath != "" {
 		logger.Info("config: " + configPath)
-		parsedRawConfig, err := parseRawConfigFromFile(configPath)
+		parsedRawConfig, err := parseCheckedRawConfigFromFile(configPath)
 		if err != nil {
 			return nil, err
 		}
-		return parsedRawConfig, nil
+		parsedRawConfig.resolveEnvFiles(filepath.Dir(configPath))
+		merged = mergeRawConfig(merged, parsedRawConfig)
+		if !parsedRawConfig.inherits() {
+			return merged, nil
+		}
 	}
 
 	logger.Info("config: (default)")
-	return defaultRawConfig(), nil
+	return mergeRawConfig(merged, defaultRawConfig()), nil
+}
+
+// mergeRawConfig merges two configurations.
+// Commands of higher come first. Log fields of higher override those of lower field by field.
+func mergeRawConfig(higher *rawConfig, lower *rawConfig) *rawConfig {
+	merged := &rawConfig{}
+	merged.Commands = append(merged.Commands, higher.Commands...)
+	merged.Commands = append(merged.Commands, lower.Commands...)
+
+	merged.Match = higher.Match
+	if merged.Match == "" {
+		merged.Match = lower.Match
+	}
+	merged.Jobs = higher.Jobs
+	if merged.Jobs == 0 {
+		merged.Jobs = lower.Jobs
+	}
+	merged.Env = mergeEnv(lower.Env, higher.Env)
+	merged.EnvFile = append(append(stringList{}, lower.EnvFile...), higher.EnvFile...)
+	merged.ExpandEnv = higher.ExpandEnv
+	if merged.ExpandEnv == nil {
+		merged.ExpandEnv = lower.ExpandEnv
+	}
+	merged.Clear = higher.Clear
+	if merged.Clear == "" {
+		merged.Clear = lower.Clear
+	}
+	merged.Output = higher.Output
+	if merged.Output == "" {
+		merged.Output = lower.Output
+	}
+	merged.Pty = higher.Pty
+	if merged.Pty == nil {
+		merged.Pty = lower.Pty
+	}
+	merged.ShutdownTimeoutMs = higher.ShutdownTimeoutMs
+	if merged.ShutdownTimeoutMs == 0 {
+		merged.ShutdownTimeoutMs = lower.ShutdownTimeoutMs
+	}
+	merged.OutputDir = higher.OutputDir
+	if merged.OutputDir == "" {
+		merged.OutputDir = lower.OutputDir
+	}
+	merged.OutputFile = higher.OutputFile
+	if merged.OutputFile == "" {
+		merged.OutputFile = lower.OutputFile
+	}
+	merged.OutputKeep = higher.OutputKeep
+	if merged.OutputKeep == 0 {
+		merged.OutputKeep = lower.OutputKeep
+	}
+	merged.OutputKeepDays = higher.OutputKeepDays
+	if merged.OutputKeepDays == 0 {
+		merged.OutputKeepDays = lower.OutputKeepDays
+	}
+
+	if higher.Log == nil && lower.Log == nil {
+		return merged
+	}
+	mergedLog := &rawLog{}
+	for _, l := range []*rawLog{lower.Log, higher.Log} {
+		if l == nil {
+			continue
+		}
+		if l.Start != "" {
+			mergedLog.Start = l.Start
+		}
+		if l.End != "" {
+			mergedLog.End = l.End
+		}
+		if l.Separator != "" {
+			mergedLog.Separator = l.Separator
+		}
+	}
+	merged.Log = mergedLog
+	return merged
+}
+
+// mergeEnv merges environment variables. higher has priority. Returns nil if both are empty.
+func mergeEnv(lower map[string]string, higher map[string]string) map[string]string {
+	if len(lower) == 0 && len(higher) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(lower)+len(higher))
+	for k, v := range lower {
+		merged[k] = v
+	}
+	for k, v := range higher {
+		merged[k] = v
+	}
+	return merged
+}
+
+// resolveEnvFiles makes relative env_file paths relative to dir, the directory of the configuration file.
+func (r *rawConfig) resolveEnvFiles(dir string) {
+	r.EnvFile = resolvePaths(r.EnvFile, dir)
+	for i := range r.Commands {
+		r.Commands[i].EnvFile = resolvePaths(r.Commands[i].EnvFile, dir)
+	}
+}
+
+func resolvePaths(paths stringList, dir string) stringList {
+	var resolved stringList
+	for _, p := range paths {
+		if p != "" && !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		resolved = append(resolved, p)
+	}
+	return resolved
+}
+
+// inherits returns false if the configuration explicitly disables inheritance.
+func (r *rawConfig) inherits() bool {
+	if r.Extends == "none" {
+		return false
+	}
+	if r.Inherit != nil && !*r.Inherit {
+		return false
+	}
+	return true
 }
 
 func defaultRawConfig() *rawConfig {
@@ -104,23 +472,22 @@ func defaultRawConfig() *rawConfig {
 	return rawConfig
 }
 
-// LoadConfigFromFile loads a configuration file.
+// LoadConfigFromFile loads a configuration file and merges it with the preferred configurations.
 func LoadConfigFromFile(configPath string) (*Config, error) {
-	bytes, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, err
-	}
-
-	rawConfig, err := parseRawConfigFromBytes(bytes)
+	rawConfig, err := loadRawConfigFromFile(configPath, homeDirPath(), workingDirPath())
 	if err != nil {
 		return nil, err
 	}
-
 	return toConfig(rawConfig), nil
 }
 
+func loadRawConfigFromFile(configPath string, home string, cwd string) (*rawConfig, error) {
+	configPaths := append([]string{configPath}, preferredConfigPaths(home, cwd)...)
+	return loadMergedRawConfig(configPaths)
+}
+
 func toConfig(rawConfig *rawConfig) *Config {
-	resultConfig := &Config{}
+	resultConfig := &Config{MatchAll: rawConfig.Match == "all", Jobs: rawConfig.Jobs, Clear: toClear(rawConfig.Clear), Output: rawConfig.Output, ShutdownTimeout: rawConfig.ShutdownTimeoutMs}
 	if len(rawConfig.Commands) == 0 {
 		logger.Notice("No commands defined in the configuration file. Gaze will not function properly.")
 	}
@@ -128,29 +495,84 @@ func toConfig(rawConfig *rawConfig) *Config {
 	for i := 0; i < len(rawConfig.Commands); i++ {
 		rawCmd := &rawConfig.Commands[i]
 
-		if rawCmd.Cmd == "" {
+		if rawCmd.Cmd == "" && len(rawCmd.Steps) == 0 {
 			logger.Error("Empty cmd (%d)", i)
 			continue
 		}
-		if rawCmd.Ext == "" && rawCmd.Re == "" {
-			logger.Debug("Both ext and re are empty (%d)", i)
-			continue
+		command := Command{
+			Cmd:         rawCmd.Cmd,
+			Ext:         nonEmpty(rawCmd.Ext),
+			Glob:        nonEmpty(rawCmd.Glob),
+			Exclude:     nonEmpty(rawCmd.Exclude),
+			Timeout:     rawCmd.Timeout,
+			Restart:     rawCmd.Restart,
+			Cwd:         rawCmd.Cwd,
+			Env:         mergeEnv(rawConfig.Env, rawCmd.Env),
+			Continue:    rawCmd.Continue,
+			Batch:       rawCmd.Batch,
+			Queue:       rawCmd.Queue,
+			CancelAfter: rawCmd.CancelAfter,
+			Group:       rawCmd.Group,
+			Steps:       toSteps(rawCmd.Steps),
+			StopSignal:  rawCmd.StopSignal,
+			StopGraceMs: rawCmd.StopGraceMs,
+			Shell:       rawCmd.Shell,
+			Script:      rawCmd.Script,
+			Interpreter: rawCmd.Interpreter,
+			Stdin:       rawCmd.Stdin,
+			Output:      rawCmd.Output,
+			EnvFile:     nonEmpty(append(append(stringList{}, rawConfig.EnvFile...), rawCmd.EnvFile...)),
+		}
+		if rawCmd.ExpandEnv != nil {
+			command.ExpandEnv = *rawCmd.ExpandEnv
+		} else if rawConfig.ExpandEnv != nil {
+			command.ExpandEnv = *rawConfig.ExpandEnv
+		}
+		if rawCmd.Pty != nil {
+			command.Pty = *rawCmd.Pty
+		} else if rawConfig.Pty != nil {
+			command.Pty = *rawConfig.Pty
+		}
+		command.OutputDir = rawCmd.OutputDir
+		if command.OutputDir == "" {
+			command.OutputDir = rawConfig.OutputDir
+		}
+		command.OutputFile = rawCmd.OutputFile
+		if command.OutputFile == "" {
+			command.OutputFile = rawConfig.OutputFile
+		}
+		if command.OutputFile == "" {
+			command.OutputFile = DefaultOutputFile
+		}
+		command.OutputKeep = rawCmd.OutputKeep
+		if command.OutputKeep == 0 {
+			command.OutputKeep = rawConfig.OutputKeep
+		}
+		command.OutputKeepDays = rawCmd.OutputKeepDays
+		if command.OutputKeepDays == 0 {
+			command.OutputKeepDays = rawConfig.OutputKeepDays
+		}
+		if command.Shell == "false" {
+			command.Shell = ""
+		}
+		if rawCmd.Retry != nil {
+			command.Retry = Retry{Count: rawCmd.Retry.Count, DelayMs: rawCmd.Retry.DelayMs, Backoff: rawCmd.Retry.Backoff}
 		}
 
 		if rawCmd.Re != "" {
 			re, err := regexp.Compile(rawCmd.Re)
-			if err == nil {
-				resultConfig.Commands = append(resultConfig.Commands, Command{Cmd: rawCmd.Cmd, Ext: rawCmd.Ext, re: re})
-			} else {
-				logger.Error("Failed to compile regexp: " + err.Error())
+			if err != nil {
+				logger.Error("Failed to compile regexp: %s", err.Error())
+				continue
 			}
-			continue
+			command.re = re
 		}
 
-		if rawCmd.Ext != "" {
-			resultConfig.Commands = append(resultConfig.Commands, Command{Cmd: rawCmd.Cmd, Ext: rawCmd.Ext})
+		if len(command.Ext) == 0 && command.re == nil && len(command.Glob) == 0 {
+			logger.Debug("ext, re and glob are all empty (%d)", i)
 			continue
 		}
+		resultConfig.Commands = append(resultConfig.Commands, command)
 	}
 
 	sourceLog := rawConfig.Log
@@ -161,8 +583,9 @@ func toConfig(rawConfig *rawConfig) *Config {
 
 	start := parseMustacheTemplate(sourceLog.Start)
 	end := parseMustacheTemplate(sourceLog.End)
+	separator := parseMustacheTemplate(sourceLog.Separator)
 
-	resultConfig.Log = &Log{start: start, end: end}
+	resultConfig.Log = &Log{start: start, end: end, separator: separator}
 
 	return resultConfig
 }
@@ -197,6 +620,47 @@ func searchConfigPath(home string) string {
 	return ""
 }
 
+// searchProjectConfigPath walks up from dir and returns the first project configuration file.
+// The search stops at the repository root (a directory containing .git) or the filesystem root.
+// home is never searched since its files are the user configuration.
+func searchProjectConfigPath(dir string, home string) string {
+	if !gutil.IsDir(dir) {
+		return ""
+	}
+	current := filepath.Clean(dir)
+	homeDir := ""
+	if home != "" {
+		homeDir = filepath.Clean(filepath.FromSlash(home))
+	}
+	for {
+		if current == homeDir {
+			return ""
+		}
+		for _, n := range []string{".gaze.yml", ".gaze.yaml", "gaze.yml", "gaze.yaml"} {
+			candidate := filepath.Join(current, n)
+			if gutil.IsFile(candidate) {
+				return filepath.ToSlash(candidate)
+			}
+		}
+		if gutil.Stat(filepath.Join(current, ".git")) != nil {
+			return ""
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			return ""
+		}
+		current = parent
+	}
+}
+
+func workingDirPath() string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	return cwd
+}
+
 func homeDirPath() string {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -213,6 +677,22 @@ func parseRawConfigFromFile(path string) (*rawConfig, error) {
 	return parseRawConfigFromBytes(bytes)
 }
 
+// parseCheckedRawConfigFromFile parses a configuration file and refuses it if it has errors.
+func parseCheckedRawConfigFromFile(path string) (*rawConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	diagnostics := checkConfigBytes(path, bytes)
+	if HasError(diagnostics) {
+		return nil, diagnosticsError(diagnostics)
+	}
+	for _, d := range diagnostics {
+		logger.Notice("%s", d.String())
+	}
+	return parseRawConfigFromBytes(bytes)
+}
+
 func parseRawConfigFromBytes(fileBuffer []byte) (*rawConfig, error) {
 	rawConfig := rawConfig{}
 	err := yaml.Unmarshal(fileBuffer, &rawConfig)
@@ -223,31 +703,107 @@ func parseRawConfigFromBytes(fileBuffer []byte) (*rawConfig, error) {
 	return &rawConfig, nil
 }
 
-// Match return true is filePath meets the condition
+// Match return true is filePath meets the condition.
+// Ext, Re and Glob are combined with AND (unset ones are ignored); values in a list are combined with OR.
+// A file that matches any of Exclude never matches.
 func (c *Command) Match(filePath string) bool {
+	_, ok := c.Submatch(filePath)
+	return ok
+}
+
+// Submatch works like Match and also returns the capture groups of Re.
+// Captures are keyed by their index ("0" is the whole match) and by their name. nil if Re is not set.
+func (c *Command) Submatch(filePath string) (map[string]string, bool) {
 	if filePath == "" {
-		return false
+		return nil, false
+	}
+	if len(c.Ext) == 0 && c.re == nil && len(c.Glob) == 0 {
+		return nil, false
+	}
+
+	if len(c.Ext) > 0 && !slices.Contains(c.Ext, filepath.Ext(filePath)) {
+		return nil, false
+	}
+	var captures map[string]string
+	if c.re != nil {
+		submatches := c.re.FindStringSubmatch(filePath)
+		if submatches == nil {
+			return nil, false
+		}
+		captures = make(map[string]string)
+		names := c.re.SubexpNames()
+		for i, submatch := range submatches {
+			captures[strconv.Itoa(i)] = submatch
+			if names[i] != "" {
+				captures[names[i]] = submatch
+			}
+		}
+	}
+	if len(c.Glob) > 0 && !matchGlobs(c.Glob, filePath) {
+		return nil, false
+	}
+	if matchGlobs(c.Exclude, filePath) {
+		return nil, false
 	}
+	return captures, true
+}
 
-	if c.Ext != "" && c.re == nil {
-		return c.Ext == filepath.Ext(filePath)
+// matchGlobs returns true if filePath (or its path relative to the current directory) matches any of the patterns
+func matchGlobs(patterns []string, filePath string) bool {
+	if len(patterns) == 0 {
+		return false
 	}
-	if c.Ext == "" && c.re != nil {
-		return c.re.MatchString(filePath)
+	candidates := []string{filepath.ToSlash(filePath)}
+	if filepath.IsAbs(filePath) {
+		rel, err := filepath.Rel(workingDirPath(), filePath)
+		if err == nil && !strings.HasPrefix(rel, "..") {
+			candidates = append(candidates, filepath.ToSlash(rel))
+		}
 	}
 
-	// Both are set
-	return c.Ext == filepath.Ext(filePath) && c.re.MatchString(filePath)
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			ok, _ := doublestar.Match(filepath.ToSlash(pattern), candidate)
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func nonEmpty(list stringList) []string {
+	var result []string
+	for _, e := range list {
+		if e != "" {
+			result = append(result, e)
+		}
+	}
+	return result
 }
 
 func (l *Log) RenderStart(params map[string]string) string {
+	if l == nil {
+		return ""
+	}
 	return renderLog(l.start, params)
 }
 
 func (l *Log) RenderEnd(params map[string]string) string {
+	if l == nil {
+		return ""
+	}
 	return renderLog(l.end, params)
 }
 
+// RenderSeparator renders the separator printed before each run. Empty if it is not set.
+func (l *Log) RenderSeparator(params map[string]string) string {
+	if l == nil {
+		return ""
+	}
+	return renderLog(l.separator, params)
+}
+
 func renderLog(tmpl *mustache.Template, params map[string]string) string {
 	if tmpl == nil {
 		return ""
@@ -7,8 +7,11 @@
 package config
 
 import (
+	"maps"
 	"os"
 	"path"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/cbroglie/mustache"
@@ -26,6 +29,33 @@ func TestNewWithFixedCommand(t *testing.T) {
 	}
 }
 
+func TestNewWithFixedCommandKeepsGlobals(t *testing.T) {
+	tempHome, err := os.MkdirTemp("", "gaze-test-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempHome)
+
+	yml := "jobs: 2\nclear: screen\noutput: prefix\nenv:\n  A: \"1\"\ncommands:\n- ext: .py\n  cmd: python {{file}}\n"
+	if err := os.WriteFile(path.Join(tempHome, ".gaze.yml"), []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := newWithFixedCommand("make", tempHome, tempHome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Commands) != 1 || config.Commands[0].Cmd != "make" || !config.Commands[0].Match("a.rb") {
+		t.Fatalf("unexpected commands: %+v", config.Commands)
+	}
+	if config.Jobs != 2 || config.Clear != ClearScreen || config.Output != OutputPrefix {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+	if config.Commands[0].Env["A"] != "1" {
+		t.Fatalf("unexpected env: %+v", config.Commands[0].Env)
+	}
+}
+
 func TestInit(t *testing.T) {
 	LoadPreferredConfig()
 }
@@ -72,6 +102,125 @@ func TestMatch(t *testing.T) {
 	}
 }
 
+func TestMatchGlobAndExclude(t *testing.T) {
+	yml := `
+extends: none
+commands:
+- ext: [.ts, .tsx]
+  glob: src/**
+  exclude: "**/*.test.ts"
+  cmd: tsc
+- glob: ["docs/*.md", "*.md"]
+  cmd: markdown
+- ext: .go
+  re: _test\.go$
+  cmd: gotest
+- ext: .go
+  exclude: [vendor/**, "**/*_gen.go"]
+  cmd: gorun
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := toConfig(rawCfg)
+	if len(c.Commands) != 4 {
+		t.Fatalf("expected 4 commands, got %d", len(c.Commands))
+	}
+
+	testCases := []struct {
+		file     string
+		expected string
+	}{
+		// ext(OR) AND glob, minus exclude
+		{"src/a.ts", "tsc"},
+		{"src/components/b.tsx", "tsc"},
+		{"src/components/b.test.ts", ""},
+		{"lib/a.ts", ""},
+		{"src/a.js", ""},
+		// glob only (OR)
+		{"README.md", "markdown"},
+		{"docs/guide.md", "markdown"},
+		{"docs/sub/guide.md", ""},
+		// ext AND re
+		{"pkg/a_test.go", "gotest"},
+		// ext with exclude
+		{"pkg/a.go", "gorun"},
+		{"vendor/x/a.go", ""},
+		{"pkg/model_gen.go", ""},
+	}
+	for _, tc := range testCases {
+		m := getFirstMatch(c, tc.file)
+		actual := ""
+		if m != nil {
+			actual = m.Cmd
+		}
+		if actual != tc.expected {
+			t.Errorf("%s: expected %q but got %q", tc.file, tc.expected, actual)
+		}
+	}
+
+	// Relative glob patterns also match absolute paths under the current directory
+	cwd, _ := os.Getwd()
+	if m := getFirstMatch(c, path.Join(cwd, "src", "a.ts")); m == nil || m.Cmd != "tsc" {
+		t.Errorf("expected tsc for an absolute path")
+	}
+
+	// A command without ext, re and glob never matches
+	empty := Command{Cmd: "x", Exclude: []string{"*.txt"}}
+	if empty.Match("a.go") {
+		t.Fatal()
+	}
+}
+
+func TestSubmatch(t *testing.T) {
+	rawCfg, err := parseRawConfigFromBytes([]byte("commands:\n- re: ^services/(?P<svc>[^/]+)/(.*)$\n  cmd: x\n- ext: .go\n  cmd: y\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := toConfig(rawCfg)
+
+	captures, ok := c.Commands[0].Submatch("services/api/main.go")
+	if !ok {
+		t.Fatal()
+	}
+	expected := map[string]string{"0": "services/api/main.go", "1": "api", "svc": "api", "2": "main.go"}
+	if !maps.Equal(captures, expected) {
+		t.Fatalf("unexpected captures: %v", captures)
+	}
+
+	captures, ok = c.Commands[0].Submatch("lib/a.go")
+	if ok || captures != nil {
+		t.Fatal()
+	}
+
+	captures, ok = c.Commands[1].Submatch("lib/a.go")
+	if !ok || captures != nil {
+		t.Fatal()
+	}
+}
+
+func TestStringList(t *testing.T) {
+	rawCfg, err := parseRawConfigFromBytes([]byte("commands:\n- ext: .go\n  glob: [a, b]\n  cmd: x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := rawCfg.Commands[0]
+	if !slices.Equal(cmd.Ext, stringList{".go"}) || !slices.Equal(cmd.Glob, stringList{"a", "b"}) {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+
+	_, err = parseRawConfigFromBytes([]byte("commands:\n- ext: {a: b}\n  cmd: x\n"))
+	if err == nil {
+		t.Fatal()
+	}
+
+	diagnostics := checkConfigBytes("gaze.yml", []byte("commands:\n- glob: \"[\"\n  cmd: x\n- ext: {a: b}\n  cmd: x\n"))
+	if len(diagnostics) != 2 || diagnostics[0].Line != 2 || diagnostics[1].Line != 4 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+}
+
 func TestInvalidYaml(t *testing.T) {
 	rawConfig, err := parseRawConfigFromBytes([]byte("aaa_bbb_ccc"))
 	if err == nil {
@@ -151,6 +300,250 @@ func TestSearchConfigPath(t *testing.T) {
 	}
 }
 
+func TestSearchProjectConfigPath(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "__gaze_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if searchProjectConfigPath("", "") != "" {
+		t.Fatal()
+	}
+
+	repoDir := path.Join(tempDir, "repo")
+	subDir := path.Join(repoDir, "a", "b")
+	os.MkdirAll(subDir, os.ModePerm)
+	os.MkdirAll(path.Join(repoDir, ".git"), os.ModePerm)
+
+	// Should be not found
+	if searchProjectConfigPath(subDir, "") != "" {
+		t.Fatal()
+	}
+
+	// Above the git root; should be ignored
+	os.Create(path.Join(tempDir, ".gaze.yml"))
+	if searchProjectConfigPath(subDir, "") != "" {
+		t.Fatal()
+	}
+
+	os.Create(path.Join(repoDir, "gaze.yml"))
+	if searchProjectConfigPath(subDir, "") != path.Join(repoDir, "gaze.yml") {
+		t.Fatal()
+	}
+
+	os.Create(path.Join(repoDir, ".gaze.yml"))
+	if searchProjectConfigPath(subDir, "") != path.Join(repoDir, ".gaze.yml") {
+		t.Fatal()
+	}
+
+	os.Create(path.Join(repoDir, "a", "gaze.yaml"))
+	if searchProjectConfigPath(subDir, "") != path.Join(repoDir, "a", "gaze.yaml") {
+		t.Fatal()
+	}
+}
+
+func TestLoadPreferredRawConfigProject(t *testing.T) {
+	tempHome, err := os.MkdirTemp("", "gaze-test-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempHome)
+
+	tempProject, err := os.MkdirTemp("", "gaze-test-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempProject)
+	os.MkdirAll(path.Join(tempProject, ".git"), os.ModePerm)
+
+	homeConfig := "commands:\n- ext: .home\n  cmd: homeCmd\n"
+	if err := os.WriteFile(path.Join(tempHome, ".gaze.yml"), []byte(homeConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rawCfg, err := loadPreferredRawConfig(tempHome, tempProject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawCfg.Commands[0].Cmd != "homeCmd" {
+		t.Fatalf("expected command 'homeCmd', got %q", rawCfg.Commands[0].Cmd)
+	}
+
+	projectConfig := "commands:\n- ext: .project\n  cmd: projectCmd\n"
+	if err := os.WriteFile(path.Join(tempProject, ".gaze.yml"), []byte(projectConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rawCfg, err = loadPreferredRawConfig(tempHome, tempProject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rawCfg.Commands[0].Cmd != "projectCmd" {
+		t.Fatalf("expected command 'projectCmd', got %q", rawCfg.Commands[0].Cmd)
+	}
+}
+
+func TestLoadPreferredRawConfigHomeFiles(t *testing.T) {
+	tempHome, err := os.MkdirTemp("", "gaze-test-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempHome)
+
+	os.MkdirAll(path.Join(tempHome, ".config", "gaze"), os.ModePerm)
+	if err := os.WriteFile(path.Join(tempHome, ".config", "gaze", "gaze.yml"), []byte("commands:\n- ext: .a\n  cmd: configCmd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(tempHome, ".gaze.yml"), []byte("commands:\n- ext: .a\n  cmd: dotCmd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outside any repository, the walk stops at home and ~/.gaze.yml is not a project configuration
+	workDir := path.Join(tempHome, "work", "sub")
+	os.MkdirAll(workDir, os.ModePerm)
+	for _, cwd := range []string{workDir, tempHome} {
+		rawCfg, err := loadPreferredRawConfig(tempHome, cwd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range rawCfg.Commands {
+			if c.Cmd == "dotCmd" {
+				t.Fatalf("%s: ~/.gaze.yml was loaded", cwd)
+			}
+		}
+		if rawCfg.Commands[0].Cmd != "configCmd" {
+			t.Fatalf("%s: expected 'configCmd', got %q", cwd, rawCfg.Commands[0].Cmd)
+		}
+	}
+}
+
+func TestMergeRawConfig(t *testing.T) {
+	higher := &rawConfig{
+		Commands: []rawCommand{{Ext: stringList{".py"}, Cmd: "higherPy"}},
+		Log:      &rawLog{Start: "higher start"},
+	}
+	lower := &rawConfig{
+		Commands: []rawCommand{{Ext: stringList{".py"}, Cmd: "lowerPy"}, {Ext: stringList{".go"}, Cmd: "lowerGo"}},
+		Log:      &rawLog{Start: "lower start", End: "lower end"},
+	}
+
+	merged := mergeRawConfig(higher, lower)
+	if len(merged.Commands) != 3 {
+		t.Fatalf("expected 3 commands, got %d", len(merged.Commands))
+	}
+	if merged.Commands[0].Cmd != "higherPy" || merged.Commands[1].Cmd != "lowerPy" || merged.Commands[2].Cmd != "lowerGo" {
+		t.Fatalf("unexpected order: %+v", merged.Commands)
+	}
+	if merged.Log.Start != "higher start" || merged.Log.End != "lower end" {
+		t.Fatalf("unexpected log: %+v", merged.Log)
+	}
+
+	merged = mergeRawConfig(&rawConfig{}, &rawConfig{})
+	if len(merged.Commands) != 0 || merged.Log != nil {
+		t.Fatalf("unexpected merge result: %+v", merged)
+	}
+}
+
+func TestMatchAllConfig(t *testing.T) {
+	merged := mergeRawConfig(&rawConfig{}, &rawConfig{Match: "all"})
+	if merged.Match != "all" || !toConfig(merged).MatchAll {
+		t.Fatal()
+	}
+	merged = mergeRawConfig(&rawConfig{Match: "first"}, &rawConfig{Match: "all"})
+	if merged.Match != "first" || toConfig(merged).MatchAll {
+		t.Fatal()
+	}
+
+	rawCfg, err := parseRawConfigFromBytes([]byte("match: all\ncommands:\n- ext: .go\n  cmd: x\n  continue: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := toConfig(rawCfg)
+	if !cfg.MatchAll || !cfg.Commands[0].Continue {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+
+	diagnostics := checkConfigBytes("gaze.yml", []byte("match: any\n"))
+	if len(diagnostics) != 1 || diagnostics[0].Line != 1 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+}
+
+func TestInherits(t *testing.T) {
+	f := false
+	tr := true
+	testCases := []struct {
+		raw      rawConfig
+		expected bool
+	}{
+		{rawConfig{}, true},
+		{rawConfig{Extends: "default"}, true},
+		{rawConfig{Extends: "none"}, false},
+		{rawConfig{Inherit: &tr}, true},
+		{rawConfig{Inherit: &f}, false},
+	}
+	for _, tc := range testCases {
+		if tc.raw.inherits() != tc.expected {
+			t.Errorf("inherits(%+v) = %v", tc.raw, !tc.expected)
+		}
+	}
+}
+
+func TestLoadRawConfigFromFileMerged(t *testing.T) {
+	tempHome, err := os.MkdirTemp("", "gaze-test-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempHome)
+
+	homeConfig := "commands:\n- ext: .home\n  cmd: homeCmd\nlog:\n  end: \"home end\"\n"
+	if err := os.WriteFile(path.Join(tempHome, ".gaze.yml"), []byte(homeConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileConfig := createTempFile("*.yml", "commands:\n- ext: .py\n  cmd: fileCmd\nlog:\n  start: \"file start\"\n")
+	defer os.Remove(fileConfig)
+
+	rawCfg, err := loadRawConfigFromFile(fileConfig, tempHome, tempHome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultCount := len(defaultRawConfig().Commands)
+	if len(rawCfg.Commands) != defaultCount+2 {
+		t.Fatalf("expected %d commands, got %d", defaultCount+2, len(rawCfg.Commands))
+	}
+	if rawCfg.Commands[0].Cmd != "fileCmd" || rawCfg.Commands[1].Cmd != "homeCmd" {
+		t.Fatalf("unexpected order: %+v", rawCfg.Commands[:2])
+	}
+	if rawCfg.Log.Start != "file start" || rawCfg.Log.End != "home end" {
+		t.Fatalf("unexpected log: %+v", rawCfg.Log)
+	}
+
+	noInheritConfig := createTempFile("*.yml", "inherit: false\ncommands:\n- ext: .py\n  cmd: fileCmd\n")
+	defer os.Remove(noInheritConfig)
+
+	rawCfg, err = loadRawConfigFromFile(noInheritConfig, tempHome, tempHome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rawCfg.Commands) != 1 || rawCfg.Log != nil {
+		t.Fatalf("expected no inheritance, got %+v", rawCfg)
+	}
+
+	// The home configuration stops inheritance from the default
+	homeConfig = "extends: none\ncommands:\n- ext: .home\n  cmd: homeCmd\n"
+	if err := os.WriteFile(path.Join(tempHome, ".gaze.yml"), []byte(homeConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rawCfg, err = loadRawConfigFromFile(fileConfig, tempHome, tempHome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rawCfg.Commands) != 2 {
+		t.Fatalf("expected 2 commands, got %d", len(rawCfg.Commands))
+	}
+}
+
 func getFirstMatch(config *Config, fileName string) *Command {
 	var result *Command
 	for _, command := range config.Commands {
@@ -164,6 +557,7 @@ func getFirstMatch(config *Config, fileName string) *Command {
 
 func testConfig() string {
 	return `#
+extends: none
 commands:
 - ext:
   cmd: run00
@@ -255,9 +649,9 @@ func TestToConfig(t *testing.T) {
 	rawCfg := &rawConfig{
 		Commands: []rawCommand{
 			// 1. Valid command with ext only.
-			{Ext: ".go", Cmd: "runGo"},
+			{Ext: stringList{".go"}, Cmd: "runGo"},
 			// 2. Valid command with ext and valid regexp.
-			{Ext: ".rb", Re: "^test", Cmd: "runRb"},
+			{Ext: stringList{".rb"}, Re: "^test", Cmd: "runRb"},
 			// 3. Both ext and re empty; should be skipped.
 			{Cmd: "badCmd"},
 			// 4. Invalid regexp; should be skipped.
@@ -265,7 +659,7 @@ func TestToConfig(t *testing.T) {
 			// 5. Valid command with regexp only.
 			{Re: "^match", Cmd: "matchCmd"},
 			// 6. ext provided as empty while re is empty; should be skipped.
-			{Ext: "", Cmd: "extOnly"},
+			{Ext: stringList{""}, Cmd: "extOnly"},
 			// 7. Valid command with regexp only.
 			{Re: "^noExt", Cmd: "regexOnly"},
 			// 8. Empty command; should be skipped.
@@ -286,13 +680,13 @@ func TestToConfig(t *testing.T) {
 
 	// Test first command.
 	cmd := cfg.Commands[0]
-	if cmd.Cmd != "runGo" || cmd.Ext != ".go" || cmd.re != nil {
+	if cmd.Cmd != "runGo" || !slices.Equal(cmd.Ext, []string{".go"}) || cmd.re != nil {
 		t.Errorf("unexpected command 0: %+v", cmd)
 	}
 
 	// Test second command.
 	cmd = cfg.Commands[1]
-	if cmd.Cmd != "runRb" || cmd.Ext != ".rb" || cmd.re == nil {
+	if cmd.Cmd != "runRb" || !slices.Equal(cmd.Ext, []string{".rb"}) || cmd.re == nil {
 		t.Errorf("unexpected command 1: %+v", cmd)
 	} else {
 		// Verify the regexp compiles and matches an example string.
@@ -327,6 +721,42 @@ func TestToConfig(t *testing.T) {
 	}
 }
 
+func TestToConfigCommandOptions(t *testing.T) {
+	yml := `
+commands:
+- ext: .go
+  cmd: go test
+  timeout: 3000
+  restart: true
+  cwd: "{{dir}}"
+  env:
+    GOFLAGS: -count=1
+  group: go
+- ext: .py
+  cmd: python
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := toConfig(rawCfg)
+
+	cmd := cfg.Commands[0]
+	if cmd.Timeout != 3000 || cmd.Restart == nil || !*cmd.Restart || cmd.Cwd != "{{dir}}" || cmd.Env["GOFLAGS"] != "-count=1" || cmd.Group != "go" {
+		t.Errorf("unexpected command 0: %+v", cmd)
+	}
+	cmd = cfg.Commands[1]
+	if cmd.Timeout != 0 || cmd.Restart != nil || cmd.Cwd != "" || cmd.Env != nil || cmd.Group != "" {
+		t.Errorf("unexpected command 1: %+v", cmd)
+	}
+
+	expectDiagnostics(t, yml)
+	diagnostics := checkConfigBytes("gaze.yml", []byte("commands:\n- ext: .go\n  cmd: go test\n  timeout: -1\n"))
+	if len(diagnostics) != 1 || diagnostics[0].Line != 4 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+}
+
 func TestToConfigNoCommands(t *testing.T) {
 	// rawConfig with no commands; only log section provided.
 	rawCfg := &rawConfig{
@@ -441,7 +871,7 @@ log:
 		t.Fatal(err)
 	}
 
-	rawCfg, err := loadPreferredRawConfig(tempHome)
+	rawCfg, err := loadPreferredRawConfig(tempHome, tempHome)
 	if err != nil {
 		t.Fatalf("loadPreferredRawConfig returned error: %s", err)
 	}
@@ -466,7 +896,7 @@ func TestLoadPreferredRawConfigDefault(t *testing.T) {
 
 	// Ensure there is no config file anywhere under tempHome.
 	// loadPreferredRawConfig will fall back to using the default configuration.
-	rawCfg, err := loadPreferredRawConfig(tempHome)
+	rawCfg, err := loadPreferredRawConfig(tempHome, tempHome)
 	if err != nil {
 		t.Fatalf("loadPreferredRawConfig returned error: %s", err)
 	}
@@ -516,3 +946,435 @@ func TestRenderLogSimple(t *testing.T) {
 		t.Fatalf("expected %q but got %q", expected, result)
 	}
 }
+
+func TestJobsConfig(t *testing.T) {
+	merged := mergeRawConfig(&rawConfig{}, &rawConfig{Jobs: 4})
+	if merged.Jobs != 4 || toConfig(merged).Jobs != 4 {
+		t.Fatal()
+	}
+	merged = mergeRawConfig(&rawConfig{Jobs: 2}, &rawConfig{Jobs: 4})
+	if merged.Jobs != 2 || toConfig(merged).Jobs != 2 {
+		t.Fatal()
+	}
+
+	expectDiagnostics(t, "jobs: -1\n", "gaze.yml:1:7: error: jobs must not be negative")
+}
+
+func TestShutdownTimeoutConfig(t *testing.T) {
+	merged := mergeRawConfig(&rawConfig{}, &rawConfig{ShutdownTimeoutMs: 3000})
+	if merged.ShutdownTimeoutMs != 3000 || toConfig(merged).ShutdownTimeout != 3000 {
+		t.Fatal()
+	}
+	merged = mergeRawConfig(&rawConfig{ShutdownTimeoutMs: 500}, &rawConfig{ShutdownTimeoutMs: 3000})
+	if toConfig(merged).ShutdownTimeout != 500 {
+		t.Fatal()
+	}
+
+	expectDiagnostics(t, "shutdown_timeout_ms: -1\n", "gaze.yml:1:22: error: shutdown_timeout_ms must not be negative")
+}
+
+func TestSteps(t *testing.T) {
+	yml := `
+commands:
+- ext: .go
+  steps:
+  - run: golangci-lint run
+    continue_on_error: true
+  - run: go test ./...
+  - run: rm -f coverage.out
+    always: true
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := toConfig(rawCfg)
+	if len(cfg.Commands) != 1 {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	cmd := cfg.Commands[0]
+	expected := []Step{
+		{Run: "golangci-lint run", ContinueOnError: true},
+		{Run: "go test ./..."},
+		{Run: "rm -f coverage.out", Always: true},
+	}
+	if !slices.Equal(cmd.Steps, expected) {
+		t.Fatalf("unexpected steps: %+v", cmd.Steps)
+	}
+	if cmd.Template() != "golangci-lint run\ngo test ./...\nrm -f coverage.out" {
+		t.Fatal(cmd.Template())
+	}
+	if (&Command{Cmd: "make"}).Template() != "make" {
+		t.Fatal()
+	}
+
+	expectDiagnostics(t, yml)
+}
+
+func TestCheckSteps(t *testing.T) {
+	yml := `commands:
+- ext: .go
+  cmd: make
+  steps:
+  - run: go test
+- ext: .go
+  steps:
+  - always: true
+  - run: "{{file"
+  - run: ls
+    retry: 1
+`
+	expectDiagnostics(t, yml,
+		`gaze.yml:5:3: error: commands[0]: cmd and steps cannot be used together`,
+		`gaze.yml:8:5: error: commands[1].steps[0]: run is empty`,
+		`gaze.yml:9:10: error: invalid template: line 1: unmatched open tag`,
+		`gaze.yml:11:5: error: unknown key "retry"`,
+	)
+}
+
+func TestRetry(t *testing.T) {
+	yml := `
+commands:
+- ext: .go
+  cmd: go test
+  retry:
+    count: 3
+    delay_ms: 500
+    backoff: 2
+- ext: .py
+  cmd: python
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := toConfig(rawCfg)
+	if cfg.Commands[0].Retry != (Retry{Count: 3, DelayMs: 500, Backoff: 2}) || cfg.Commands[1].Retry != (Retry{}) {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	expectDiagnostics(t, yml)
+
+	expectDiagnostics(t, "commands:\n- ext: .go\n  cmd: go test\n  retry:\n    count: -1\n    times: 3\n",
+		"gaze.yml:5:12: error: commands[0]: retry.count must not be negative",
+		`gaze.yml:6:5: error: unknown key "times"`,
+	)
+}
+
+func TestStopSignal(t *testing.T) {
+	yml := `
+commands:
+- ext: .py
+  cmd: python server.py
+  stop_signal: SIGINT
+  stop_grace_ms: 3000
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := toConfig(rawCfg).Commands[0]
+	if cmd.StopSignal != "SIGINT" || cmd.StopGraceMs != 3000 {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+	expectDiagnostics(t, yml)
+
+	expectDiagnostics(t, "commands:\n- ext: .py\n  cmd: python\n  stop_signal: TERM\n  stop_grace_ms: -1\n",
+		"gaze.yml:4:16: error: commands[0]: stop_signal must be one of SIGTERM, SIGINT, SIGHUP, SIGQUIT, SIGKILL",
+		"gaze.yml:5:18: error: commands[0]: stop_grace_ms must not be negative",
+	)
+}
+
+func TestShell(t *testing.T) {
+	yml := `
+commands:
+- ext: .go
+  cmd: go test ./... | tee out.txt
+  shell: bash
+- ext: .rb
+  cmd: cd sub && make
+  shell: true
+- ext: .py
+  cmd: python "{{file}}"
+  shell: false
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := toConfig(rawCfg).Commands
+	if commands[0].Shell != "bash" || commands[1].Shell != ShellDefault || commands[2].Shell != "" {
+		t.Fatalf("unexpected commands: %+v", commands)
+	}
+}
+
+func TestScript(t *testing.T) {
+	yml := `
+commands:
+- ext: .sh
+  cmd: |
+    cd sub
+    export A=1
+    make
+  script: true
+  interpreter: bash -euo pipefail
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := toConfig(rawCfg).Commands[0]
+	if !cmd.Script || cmd.Interpreter != "bash -euo pipefail" {
+		t.Fatalf("unexpected command: %+v", cmd)
+	}
+	expectDiagnostics(t, yml)
+
+	expectDiagnostics(t, "commands:\n- ext: .py\n  steps:\n  - run: ls\n  script: true\n- ext: .rb\n  cmd: ruby\n  interpreter: bash\n",
+		"gaze.yml:5:11: error: commands[0]: script and steps cannot be used together",
+		"gaze.yml:8:16: warning: commands[1]: interpreter is ignored without script: true",
+	)
+}
+
+func TestGlobalEnv(t *testing.T) {
+	yml := `
+env:
+  A: global
+  B: global
+env_file: .env
+expand_env: true
+commands:
+- ext: .go
+  cmd: go test $GOFLAGS ./...
+  env:
+    B: command
+  env_file: [.env.local]
+- ext: .py
+  cmd: python "{{file}}"
+  expand_env: false
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := toConfig(rawCfg).Commands
+	if !maps.Equal(commands[0].Env, map[string]string{"A": "global", "B": "command"}) ||
+		!slices.Equal(commands[0].EnvFile, []string{".env", ".env.local"}) ||
+		!commands[0].ExpandEnv {
+		t.Fatalf("unexpected command: %+v", commands[0])
+	}
+	if !maps.Equal(commands[1].Env, map[string]string{"A": "global", "B": "global"}) ||
+		!slices.Equal(commands[1].EnvFile, []string{".env"}) ||
+		commands[1].ExpandEnv {
+		t.Fatalf("unexpected command: %+v", commands[1])
+	}
+	expectDiagnostics(t, yml)
+
+	higher, _ := parseRawConfigFromBytes([]byte("env:\n  A: higher\nenv_file: .env.higher\ncommands: []\n"))
+	merged := mergeRawConfig(higher, rawCfg)
+	if !maps.Equal(merged.Env, map[string]string{"A": "higher", "B": "global"}) ||
+		!slices.Equal([]string(merged.EnvFile), []string{".env", ".env.higher"}) ||
+		merged.ExpandEnv == nil || !*merged.ExpandEnv {
+		t.Fatalf("unexpected config: %+v", merged)
+	}
+}
+
+func TestEnvFileRelativeToConfig(t *testing.T) {
+	tempHome, err := os.MkdirTemp("", "gaze-test-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempHome)
+
+	tempProject, err := os.MkdirTemp("", "gaze-test-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempProject)
+	os.MkdirAll(path.Join(tempProject, ".git"), os.ModePerm)
+
+	homeConfig := "env_file: .env.home\ncommands:\n- ext: .home\n  cmd: homeCmd\n"
+	if err := os.WriteFile(path.Join(tempHome, ".gaze.yml"), []byte(homeConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Absolute paths are kept as they are
+	sharedEnv := path.Join(tempHome, "shared.env")
+	projectConfig := "commands:\n- ext: .go\n  cmd: go test\n  env_file: [.env, " + sharedEnv + "]\n"
+	if err := os.WriteFile(path.Join(tempProject, ".gaze.yml"), []byte(projectConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run from a subdirectory of the project
+	subDir := path.Join(tempProject, "sub")
+	os.MkdirAll(subDir, os.ModePerm)
+	rawCfg, err := loadPreferredRawConfig(tempHome, subDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := toConfig(rawCfg).Commands
+	expected := []string{path.Join(tempHome, ".env.home"), path.Join(tempProject, ".env"), sharedEnv}
+	if !slices.Equal(commands[0].EnvFile, expected) {
+		t.Fatalf("unexpected env_file: %v", commands[0].EnvFile)
+	}
+}
+
+func TestClear(t *testing.T) {
+	for value, expected := range map[string]string{"true": ClearScreen, "screen": ClearScreen, "scrollback": ClearScrollback, "false": ""} {
+		rawCfg, err := parseRawConfigFromBytes([]byte("clear: " + value + "\ncommands: []\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if toConfig(rawCfg).Clear != expected {
+			t.Fatalf("unexpected clear for %s: %q", value, toConfig(rawCfg).Clear)
+		}
+	}
+
+	merged := mergeRawConfig(&rawConfig{}, &rawConfig{Clear: "scrollback"})
+	if toConfig(merged).Clear != ClearScrollback {
+		t.Fatal()
+	}
+	merged = mergeRawConfig(&rawConfig{Clear: "false"}, &rawConfig{Clear: "scrollback"})
+	if toConfig(merged).Clear != "" {
+		t.Fatal()
+	}
+
+	expectDiagnostics(t, "clear: all\n", "gaze.yml:1:8: error: clear must be true, false, screen or scrollback")
+}
+
+func TestRenderSeparator(t *testing.T) {
+	rawCfg, err := parseRawConfigFromBytes([]byte("log:\n  separator: \"[{{command}}] \"\ncommands: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := toConfig(rawCfg).Log
+	if log.RenderSeparator(map[string]string{"command": "make"}) != "[make] " {
+		t.Fatal()
+	}
+	if toConfig(&rawConfig{}).Log.RenderSeparator(map[string]string{}) != "" {
+		t.Fatal()
+	}
+	var nilLog *Log
+	if nilLog.RenderSeparator(map[string]string{}) != "" {
+		t.Fatal()
+	}
+}
+
+func TestOutput(t *testing.T) {
+	yml := `
+output: prefix
+commands:
+- ext: .go
+  cmd: go test ./...
+  output: grouped
+- ext: .py
+  cmd: python "{{file}}"
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := toConfig(rawCfg)
+	if cfg.Output != OutputPrefix || cfg.Commands[0].Output != OutputGrouped || cfg.Commands[1].Output != "" {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	expectDiagnostics(t, yml)
+
+	merged := mergeRawConfig(&rawConfig{}, rawCfg)
+	if merged.Output != OutputPrefix {
+		t.Fatal()
+	}
+	merged = mergeRawConfig(&rawConfig{Output: OutputRaw}, rawCfg)
+	if merged.Output != OutputRaw {
+		t.Fatal()
+	}
+
+	expectDiagnostics(t, "output: all\ncommands:\n- ext: .go\n  cmd: go test\n  output: lines\n",
+		"gaze.yml:1:9: error: output must be one of raw, prefix, grouped",
+		"gaze.yml:5:11: error: commands[0]: output must be one of raw, prefix, grouped",
+	)
+}
+
+func TestPty(t *testing.T) {
+	yml := `
+pty: true
+commands:
+- ext: .go
+  cmd: go test ./...
+- ext: .py
+  cmd: python "{{file}}"
+  pty: false
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := toConfig(rawCfg).Commands
+	if !commands[0].Pty || commands[1].Pty {
+		t.Fatalf("unexpected commands: %+v", commands)
+	}
+	merged := mergeRawConfig(&rawConfig{}, rawCfg)
+	if merged.Pty == nil || !*merged.Pty {
+		t.Fatal()
+	}
+
+	expectDiagnostics(t, "commands:\n- ext: .py\n  cmd: python -i\n  stdin: true\n  pty: true\n", "gaze.yml:5:8: warning: commands[0]: pty is ignored with stdin: true")
+}
+
+func TestOutputDir(t *testing.T) {
+	yml := `
+output_dir: .gaze/logs
+output_keep: 20
+commands:
+- ext: .go
+  cmd: go test ./...
+  output_keep_days: 7
+- ext: .py
+  cmd: python "{{file}}"
+  output_dir: logs
+  output_file: "{{key}}-{{base}}.log"
+  output_keep: 5
+`
+	rawCfg, err := parseRawConfigFromBytes([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := toConfig(rawCfg).Commands
+	if commands[0].OutputDir != ".gaze/logs" || commands[0].OutputFile != DefaultOutputFile ||
+		commands[0].OutputKeep != 20 || commands[0].OutputKeepDays != 7 {
+		t.Fatalf("unexpected command: %+v", commands[0])
+	}
+	if commands[1].OutputDir != "logs" || commands[1].OutputFile != "{{key}}-{{base}}.log" ||
+		commands[1].OutputKeep != 5 || commands[1].OutputKeepDays != 0 {
+		t.Fatalf("unexpected command: %+v", commands[1])
+	}
+	expectDiagnostics(t, yml)
+
+	merged := mergeRawConfig(&rawConfig{OutputKeep: 3}, rawCfg)
+	if merged.OutputDir != ".gaze/logs" || merged.OutputKeep != 3 {
+		t.Fatalf("unexpected config: %+v", merged)
+	}
+
+	diagnostics := checkConfigBytes("gaze.yml", []byte("output_keep: -1\ncommands:\n- ext: .go\n  cmd: go test\n  output_file: \"{{base\"\n  output_keep_days: -1\n"))
+	if len(diagnostics) != 3 ||
+		diagnostics[0].String() != "gaze.yml:1:14: error: output_keep must not be negative" ||
+		!strings.HasPrefix(diagnostics[1].String(), "gaze.yml:5:16: error: invalid template:") ||
+		diagnostics[2].String() != "gaze.yml:6:21: error: commands[0]: output_keep_days must not be negative" {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+}
+
+func TestCommandKey(t *testing.T) {
+	c1 := Command{Cmd: `python "{{file}}"`}
+	c2 := Command{Cmd: `python3 "{{file}}"`}
+	if !strings.HasPrefix(c1.Key(), "python_file-") || len(c1.Key()) != len("python_file-")+8 {
+		t.Fatal(c1.Key())
+	}
+	if c1.Key() == c2.Key() || c1.Key() != (&Command{Cmd: c1.Cmd}).Key() {
+		t.Fatal()
+	}
+	long := Command{Cmd: strings.Repeat("make ", 20)}
+	if !strings.HasPrefix(long.Key(), "make_make_make_make_make_make_ma-") || len(long.Key()) != 32+1+8 {
+		t.Fatal(long.Key())
+	}
+	if len((&Command{Cmd: "$$"}).Key()) != 8 {
+		t.Fatal()
+	}
+}
@@ -0,0 +1,118 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/logger"
+	"github.com/wtetsu/gaze/pkg/notify"
+	"github.com/wtetsu/gaze/pkg/uniq"
+)
+
+// batches collects events per command during its collection window.
+type batches struct {
+	batches map[*config.Command]*uniq.Uniq
+	flushes chan *config.Command
+	done    chan struct{} // Closed when nobody receives flushes anymore
+	once    sync.Once
+	mutex   sync.Mutex
+}
+
+func newBatches() *batches {
+	return &batches{
+		batches: make(map[*config.Command]*uniq.Uniq),
+		flushes: make(chan *config.Command),
+		done:    make(chan struct{}),
+	}
+}
+
+// add adds an event to the batch of the command. The first event of a batch starts the window.
+func (b *batches) add(commandConfig *config.Command, event notify.Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	files, ok := b.batches[commandConfig]
+	if !ok {
+		files = uniq.New()
+		b.batches[commandConfig] = files
+		b.schedule(commandConfig)
+	}
+	files.Add(event.Name)
+	logger.Debug("Batch: %s (%d)", event.Name, files.Len())
+}
+
+// schedule requests a flush after the collection window. The request is discarded after close.
+func (b *batches) schedule(commandConfig *config.Command) {
+	time.AfterFunc(time.Duration(commandConfig.Batch)*time.Millisecond, func() {
+		// Checked first since select picks a random case when both are ready
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		select {
+		case b.flushes <- commandConfig:
+		case <-b.done:
+		}
+	})
+}
+
+// close stops pending flush requests.
+func (b *batches) close() {
+	b.once.Do(func() {
+		close(b.done)
+	})
+}
+
+// files returns the files collected for the command.
+func (b *batches) files(commandConfig *config.Command) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	files, ok := b.batches[commandConfig]
+	if !ok {
+		return nil
+	}
+	return append([]string{}, files.List()...)
+}
+
+// take removes the batch of the command.
+func (b *batches) take(commandConfig *config.Command) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.batches, commandConfig)
+}
+
+// handleBatch runs a command once for all the files collected in its window.
+// If the command is running, the flush follows the queue policy like a single event.
+// A queued batch keeps collecting files until it runs.
+func (g *Gazer) handleBatch(commandConfigs *config.Config, timeoutMills int64, restart bool, commandConfig *config.Command) {
+	files := g.batches.files(commandConfig)
+	if len(files) == 0 {
+		return
+	}
+	filePath := files[0]
+
+	params := templateParams(commandConfig, filePath, files)
+	inv := renderInvocation(commandConfig, filePath, params, timeoutMills, restart)
+	if inv == nil {
+		g.batches.take(commandConfig)
+		return
+	}
+
+	event := notify.Event{Name: filePath, Time: time.Now().UnixNano()}
+	launched := g.dispatch(inv, event, commandConfigs.Log)
+	if launched || inv.queuePolicy == config.QueueDrop {
+		g.batches.take(commandConfig)
+		return
+	}
+	logger.Debug("Batch pending: %s (%d)", inv.queueManageKey, len(files))
+}
@@ -0,0 +1,148 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/notify"
+)
+
+func TestBatches(t *testing.T) {
+	b := newBatches()
+	commandConfig := &config.Command{Cmd: "eslint {{files}}", Batch: 10}
+
+	if b.files(commandConfig) != nil {
+		t.Fatal()
+	}
+
+	b.add(commandConfig, notify.Event{Name: "a.js", Time: 1})
+	b.add(commandConfig, notify.Event{Name: "b.js", Time: 2})
+	b.add(commandConfig, notify.Event{Name: "a.js", Time: 3})
+
+	files := b.files(commandConfig)
+	if len(files) != 2 || files[0] != "a.js" || files[1] != "b.js" {
+		t.Fatal(files)
+	}
+
+	select {
+	case flushed := <-b.flushes:
+		if flushed != commandConfig {
+			t.Fatal()
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not flushed")
+	}
+
+	b.take(commandConfig)
+	if b.files(commandConfig) != nil {
+		t.Fatal()
+	}
+}
+
+func TestBatchTemplateParams(t *testing.T) {
+	commandConfig := &config.Command{Cmd: "eslint {{files}} # {{count}} {{file}}", Batch: 10}
+	params := templateParams(commandConfig, "src/a.js", []string{"src/a.js", "src/b c.js"})
+	commandStringList := renderCommandList(commandConfig, "src/a.js", params, &environment{})
+	if len(commandStringList) != 1 || commandStringList[0] != "eslint 'src/a.js' 'src/b c.js' # 2 src/a.js" {
+		t.Fatal(commandStringList)
+	}
+
+	inv, err := newInvocation(commandConfig, commandStringList, "src/a.js", params, &environment{}, 1000, false)
+	if err != nil || inv.queueManageKey != "batch\n\neslint {{files}} # {{count}} {{file}}" {
+		t.Fatal(inv, err)
+	}
+
+	cmd := createCommand(commandStringList[0], commandOptions{})
+	if len(cmd.Args) != 6 || cmd.Args[2] != "src/b c.js" {
+		t.Fatal(cmd.Args)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	f := newFixture(t)
+
+	gazer, _ := New([]string{filepath.Join(f.dir, "*.py")}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	var commandConfigs config.Config
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{
+		Ext:   []string{".py"},
+		Cmd:   f.record("{{count}}"),
+		Batch: 300,
+	})
+
+	go gazer.Run(&commandConfigs, 10*1000, false)
+	now := time.Now().UnixNano()
+	emit(gazer, notify.Event{Name: f.py1, Time: now}, notify.Event{Name: f.py2, Time: now}, notify.Event{Name: f.py1, Time: now})
+
+	lines := f.waitForLines(t, gazer, 1)
+	if len(lines) != 1 || lines[0] != "2" {
+		t.Fatal(lines)
+	}
+}
+
+func TestBatchesClose(t *testing.T) {
+	b := newBatches()
+	commandConfig := &config.Command{Cmd: "eslint {{files}}", Batch: 1}
+	b.close()
+	b.close()
+
+	b.add(commandConfig, notify.Event{Name: "a.js", Time: 1})
+	select {
+	case <-b.flushes:
+		t.Fatal("flushed after close")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBatchWhileRunning(t *testing.T) {
+	gazer, _ := New([]string{"*.js"}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	var commandConfigs config.Config
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".js"}, Cmd: `python -c "pass" {{files}}`, Batch: 10000})
+	commandConfig := &commandConfigs.Commands[0]
+	inv := prepareInvocation(commandConfig, "a.js", 1000, false)
+
+	// Drop discards the batch
+	commandConfig.Queue = config.QueueDrop
+	gazer.commands.update(inv.queueManageKey, newProcess(nil))
+	gazer.batches.add(commandConfig, notify.Event{Name: "a.js", Time: 1})
+	gazer.handleBatch(&commandConfigs, 1000, false, commandConfig)
+	if gazer.InvokeCount() != 0 || gazer.batches.files(commandConfig) != nil || gazer.commands.queued(inv.queueManageKey) {
+		t.Fatal()
+	}
+
+	// Coalesce queues the batch, which keeps collecting files
+	commandConfig.Queue = config.QueueCoalesce
+	gazer.batches.add(commandConfig, notify.Event{Name: "a.js", Time: 2})
+	gazer.handleBatch(&commandConfigs, 1000, false, commandConfig)
+	gazer.batches.add(commandConfig, notify.Event{Name: "b.js", Time: 3})
+	if gazer.InvokeCount() != 0 || !gazer.commands.queued(inv.queueManageKey) {
+		t.Fatal()
+	}
+
+	// The queued batch runs with all the files when the command ends
+	event := gazer.commands.dequeue(inv.queueManageKey)
+	if event == nil {
+		t.Fatal()
+	}
+	gazer.handleRequeue(&commandConfigs, 1000, false, requeuedEvent{event: *event, queueManageKey: inv.queueManageKey})
+	if gazer.InvokeCount() != 1 || gazer.batches.files(commandConfig) != nil {
+		t.Fatal(gazer.InvokeCount())
+	}
+}
@@ -7,8 +7,9 @@
 package gazer
 
 import (
-	"os/exec"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/wtetsu/gaze/pkg/notify"
@@ -16,31 +17,121 @@ import (
 
 type commands struct {
 	commands map[string]command
-	events   map[string]notify.Event
+	events   map[string][]notify.Event
+	launched map[string]int64
 	mutex    sync.Mutex
 }
 
 type command struct {
-	cmd          *exec.Cmd
+	proc         *process
 	lastLaunched int64
+	waiting      chan struct{} // Closed to cancel while waiting for a slot
+	group        string
+	stop         stopOptions
+	stopped      *atomic.Bool // Tells the invocation that the command has been stopped
 }
 
 func newCommands() commands {
 	return commands{
 		commands: make(map[string]command),
-		events:   make(map[string]notify.Event),
+		events:   make(map[string][]notify.Event),
+		launched: make(map[string]int64),
 	}
 }
 
-func (c *commands) update(key string, cmd *exec.Cmd) {
+func (c *commands) update(key string, proc *process) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if cmd == nil {
+	if proc == nil {
 		delete(c.commands, key)
 		return
 	}
-	c.commands[key] = command{cmd: cmd, lastLaunched: time.Now().UnixNano()}
+	current := c.commands[key]
+	c.commands[key] = command{proc: proc, lastLaunched: time.Now().UnixNano(), group: current.group, stop: current.stop, stopped: current.stopped}
+}
+
+// wait marks the command as waiting for a slot. The returned channel is closed by cancelWait.
+// stopped is set when the command is stopped.
+func (c *commands) wait(key string, group string, stop stopOptions, stopped *atomic.Bool) chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	waiting := make(chan struct{})
+	c.commands[key] = command{waiting: waiting, lastLaunched: time.Now().UnixNano(), group: group, stop: stop, stopped: stopped}
+	return waiting
+}
+
+// markStopped marks the command as stopped and returns it. nil if the command is not running.
+func (c *commands) markStopped(key string) *command {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cmd, ok := c.commands[key]
+	if !ok {
+		return nil
+	}
+	if cmd.stopped != nil {
+		cmd.stopped.Store(true)
+	}
+	return &cmd
+}
+
+// keys returns the keys of the running or waiting commands.
+func (c *commands) keys() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var keys []string
+	for key := range c.commands {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keysInGroup returns the keys of the running or waiting commands in the group.
+func (c *commands) keysInGroup(group string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var keys []string
+	for key, cmd := range c.commands {
+		if cmd.group == group {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// start marks a waiting command as started so that it is no longer canceled by cancelWait.
+// Returns false if the wait has been canceled or replaced.
+func (c *commands) start(key string, waiting <-chan struct{}) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cmd, ok := c.commands[key]
+	if !ok || cmd.waiting == nil || cmd.waiting != waiting {
+		return false
+	}
+	cmd.waiting = nil
+	c.commands[key] = cmd
+	return true
+}
+
+// cancelWait cancels the command if it has not started yet. Returns true if it was canceled.
+func (c *commands) cancelWait(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cmd, ok := c.commands[key]
+	if !ok || cmd.proc != nil || cmd.waiting == nil {
+		return false
+	}
+	close(cmd.waiting)
+	delete(c.commands, key)
+	return true
 }
 
 func (c *commands) get(key string) *command {
@@ -54,25 +145,77 @@ func (c *commands) get(key string) *command {
 	return &cmd
 }
 
+// enqueue keeps only the latest event (coalesce).
 func (c *commands) enqueue(commandString string, event notify.Event) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	c.events[commandString] = event
+	c.events[commandString] = []notify.Event{event}
+}
+
+// enqueueDistinct appends an event unless an event of the same file is already queued.
+func (c *commands) enqueueDistinct(commandString string, event notify.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, e := range c.events[commandString] {
+		if e.Name == event.Name {
+			return
+		}
+	}
+	c.events[commandString] = append(c.events[commandString], event)
+}
+
+// queued returns true if an event is waiting for the command.
+func (c *commands) queued(commandString string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.events[commandString]) > 0
+}
+
+// clearQueue removes all the queued events.
+func (c *commands) clearQueue(commandString string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.events, commandString)
 }
 
+// dequeue returns the oldest queued event.
 func (c *commands) dequeue(commandString string) *notify.Event {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	event, ok := c.events[commandString]
+	events, ok := c.events[commandString]
 
-	if !ok {
+	if !ok || len(events) == 0 {
 		return nil
 	}
 
 	// delete both event and command
-	delete(c.events, commandString)
+	event := events[0]
+	if len(events) == 1 {
+		delete(c.events, commandString)
+	} else {
+		c.events[commandString] = events[1:]
+	}
 	delete(c.commands, commandString)
 	return &event
 }
+
+// markLaunched records the time the command was launched last.
+func (c *commands) markLaunched(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.launched[key] = time.Now().UnixNano()
+}
+
+// lastLaunched returns the time the command was launched last. 0 if never.
+func (c *commands) lastLaunched(key string) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.launched[key]
+}
@@ -7,7 +7,6 @@
 package gazer
 
 import (
-	"os/exec"
 	"testing"
 	"time"
 
@@ -22,8 +21,7 @@ func TestCommandsBasic1(t *testing.T) {
 	if commands.get(key) != nil {
 		t.Fatal()
 	}
-	var cmd exec.Cmd
-	commands.update(key, &cmd)
+	commands.update(key, newProcess(nil))
 	if commands.get(key) == nil {
 		t.Fatal()
 	}
@@ -75,8 +73,7 @@ func TestCommandsParallel(t *testing.T) {
 	}()
 	go func() {
 		for i := 0; i < 100; i++ {
-			var cmd exec.Cmd
-			commands.update(key, &cmd)
+			commands.update(key, newProcess(nil))
 			time.Sleep(1 * time.Millisecond)
 		}
 	}()
@@ -88,3 +85,120 @@ func TestCommandsParallel(t *testing.T) {
 	}()
 
 }
+
+func TestCommandsLastLaunched(t *testing.T) {
+	commands := newCommands()
+
+	if commands.lastLaunched("key01") != 0 {
+		t.Fatal()
+	}
+	before := time.Now().UnixNano()
+	commands.markLaunched("key01")
+	if commands.lastLaunched("key01") < before {
+		t.Fatal()
+	}
+	commands.update("key01", nil)
+	if commands.lastLaunched("key01") < before || commands.lastLaunched("key02") != 0 {
+		t.Fatal()
+	}
+}
+
+func TestCommandsEnqueueDistinct(t *testing.T) {
+	commands := newCommands()
+
+	key := "key01"
+
+	commands.enqueueDistinct(key, notify.Event{Name: "a.py", Time: 1})
+	commands.enqueueDistinct(key, notify.Event{Name: "b.py", Time: 2})
+	commands.enqueueDistinct(key, notify.Event{Name: "a.py", Time: 3})
+
+	e1 := commands.dequeue(key)
+	e2 := commands.dequeue(key)
+	if e1 == nil || e1.Name != "a.py" || e1.Time != 1 || e2 == nil || e2.Name != "b.py" {
+		t.Fatal(e1, e2)
+	}
+	if commands.dequeue(key) != nil {
+		t.Fatal()
+	}
+
+	commands.enqueue(key, notify.Event{Name: "a.py", Time: 4})
+	commands.enqueue(key, notify.Event{Name: "b.py", Time: 5})
+	e3 := commands.dequeue(key)
+	if e3 == nil || e3.Name != "b.py" || commands.dequeue(key) != nil {
+		t.Fatal(e3)
+	}
+
+	commands.enqueueDistinct(key, notify.Event{Name: "a.py", Time: 6})
+	commands.clearQueue(key)
+	if commands.dequeue(key) != nil {
+		t.Fatal()
+	}
+}
+
+func TestCommandsWait(t *testing.T) {
+	commands := newCommands()
+
+	key := "key01"
+
+	waiting := commands.wait(key, "", stopOptions{}, nil)
+	if commands.get(key) == nil {
+		t.Fatal()
+	}
+	if !commands.cancelWait(key) {
+		t.Fatal()
+	}
+	select {
+	case <-waiting:
+	default:
+		t.Fatal("not canceled")
+	}
+	if commands.get(key) != nil || commands.cancelWait(key) {
+		t.Fatal()
+	}
+
+	commands.wait(key, "", stopOptions{}, nil)
+	commands.update(key, newProcess(nil))
+	if commands.cancelWait(key) || commands.get(key) == nil {
+		t.Fatal()
+	}
+
+	// A started command is no longer canceled
+	waiting = commands.wait(key, "", stopOptions{}, nil)
+	if !commands.start(key, waiting) || commands.cancelWait(key) || commands.get(key) == nil {
+		t.Fatal()
+	}
+
+	// A canceled or replaced wait does not start
+	waiting = commands.wait(key, "", stopOptions{}, nil)
+	commands.cancelWait(key)
+	if commands.start(key, waiting) {
+		t.Fatal()
+	}
+	waiting = commands.wait(key, "", stopOptions{}, nil)
+	commands.cancelWait(key)
+	commands.wait(key, "", stopOptions{}, nil)
+	if commands.start(key, waiting) {
+		t.Fatal()
+	}
+}
+
+func TestCommandsKeysInGroup(t *testing.T) {
+	commands := newCommands()
+
+	commands.wait("key01", "group1", stopOptions{}, nil)
+	commands.wait("key02", "group1", stopOptions{}, nil)
+	commands.wait("key03", "group2", stopOptions{}, nil)
+	commands.wait("key04", "", stopOptions{}, nil)
+
+	commands.update("key01", newProcess(nil))
+
+	keys := commands.keysInGroup("group1")
+	if len(keys) != 2 || keys[0] != "key01" || keys[1] != "key02" {
+		t.Fatal(keys)
+	}
+	commands.update("key01", nil)
+	keys = commands.keysInGroup("group1")
+	if len(keys) != 1 || keys[0] != "key02" {
+		t.Fatal(keys)
+	}
+}
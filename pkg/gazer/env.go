@@ -0,0 +1,161 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wtetsu/gaze/pkg/config"
+)
+
+// environment holds the additional environment variables of a command.
+type environment struct {
+	vars   map[string]string
+	masked map[string]bool // Keys whose values are hidden in logs (loaded from env_file)
+}
+
+// loadEnvironment loads env_file and env of a command. env has priority over env_file.
+func loadEnvironment(commandConfig *config.Command) (*environment, error) {
+	env := &environment{vars: map[string]string{}, masked: map[string]bool{}}
+	for _, envFile := range commandConfig.EnvFile {
+		vars, err := readEnvFile(envFile)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range vars {
+			env.vars[k] = v
+			env.masked[k] = true
+		}
+	}
+
+	// Values of env are expanded with env_file and the environment of Gaze, not with each other
+	values := make(map[string]string, len(commandConfig.Env))
+	for k, v := range commandConfig.Env {
+		if commandConfig.ExpandEnv {
+			v = expandEnv(v, env.lookup)
+		}
+		values[k] = v
+	}
+	for k, v := range values {
+		env.vars[k] = v
+		delete(env.masked, k)
+	}
+	return env, nil
+}
+
+// lookup returns the value of a variable. The environment of Gaze is used if it is not set.
+func (e *environment) lookup(key string) (string, bool) {
+	if v, ok := e.vars[key]; ok {
+		return v, true
+	}
+	return os.LookupEnv(key)
+}
+
+// expandEnv replaces $VAR, ${VAR}, ${VAR:-default} and ${VAR-default}. $$ is replaced with $.
+func expandEnv(s string, lookup func(string) (string, bool)) string {
+	return os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		if key, defaultValue, ok := strings.Cut(name, ":-"); ok {
+			v, found := lookup(key)
+			if !found || v == "" {
+				return expandEnv(defaultValue, lookup)
+			}
+			return v
+		}
+		if key, defaultValue, ok := strings.Cut(name, "-"); ok {
+			v, found := lookup(key)
+			if !found {
+				return expandEnv(defaultValue, lookup)
+			}
+			return v
+		}
+		v, _ := lookup(name)
+		return v
+	})
+}
+
+// readEnvFile reads a dotenv file.
+// Each line is KEY=value. "export ", quotes and comments starting with # are supported.
+func readEnvFile(filePath string) (map[string]string, error) {
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := map[string]string{}
+	for i, rawLine := range newLines.Split(string(b), -1) {
+		line := strings.TrimSpace(rawLine)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			// The line is not shown since it may contain a secret
+			return nil, fmt.Errorf("%s:%d: invalid line", filePath, i+1)
+		}
+		vars[key] = parseEnvValue(strings.TrimSpace(value))
+	}
+	return vars, nil
+}
+
+func parseEnvValue(value string) string {
+	if strings.HasPrefix(value, "'") {
+		if end := strings.Index(value[1:], "'"); end >= 0 {
+			return value[1 : end+1]
+		}
+	}
+	if strings.HasPrefix(value, `"`) {
+		if end := closingQuote(value); end > 0 {
+			unquoted, err := strconv.Unquote(value[:end+1])
+			if err != nil {
+				return value[1:end]
+			}
+			return unquoted
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value
+}
+
+// closingQuote returns the index of the double quote closing value[0]. -1 if not found.
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// list returns the variables as "KEY=value" sorted by key.
+func (e *environment) list() []string {
+	return toEnvList(e.vars)
+}
+
+// maskedList returns the variables for logs. Values from env_file are hidden.
+func (e *environment) maskedList() []string {
+	masked := make(map[string]string, len(e.vars))
+	for k, v := range e.vars {
+		if e.masked[k] {
+			v = "***"
+		}
+		masked[k] = v
+	}
+	return toEnvList(masked)
+}
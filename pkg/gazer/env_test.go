@@ -0,0 +1,146 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wtetsu/gaze/pkg/config"
+)
+
+func TestExpandEnv(t *testing.T) {
+	vars := map[string]string{"A": "1", "EMPTY": ""}
+	lookup := func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+	testCases := []struct {
+		s        string
+		expected string
+	}{
+		{"go test $A ${A}", "go test 1 1"},
+		{"${NONE:-x} ${EMPTY:-x} ${A:-x}", "x x 1"},
+		{"${NONE-x} ${EMPTY-x} ${A-x}", "x  1"},
+		{"${NONE:-$A}", "1"},
+		{"$NONE.txt", ".txt"},
+		{"echo $$A {{file}}", "echo $A {{file}}"},
+	}
+	for _, tc := range testCases {
+		if r := expandEnv(tc.s, lookup); r != tc.expected {
+			t.Fatalf("%s: %q", tc.s, r)
+		}
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	envFile := createTempFile("*.env", strings.Join([]string{
+		"# comment",
+		"",
+		"A=1",
+		"export B = two words ",
+		`C="a \"b\"\nc" # comment`,
+		"D='$x # y'",
+		"E=e # comment",
+		"F=",
+	}, "\n"))
+
+	vars, err := readEnvFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"A": "1", "B": "two words", "C": "a \"b\"\nc", "D": "$x # y", "E": "e", "F": ""}
+	if !reflect.DeepEqual(vars, expected) {
+		t.Fatalf("%q", vars)
+	}
+
+	os.WriteFile(envFile, []byte("A=1\nSECRET\n"), 0644)
+	_, err = readEnvFile(envFile)
+	if err == nil || !strings.HasSuffix(err.Error(), ":2: invalid line") {
+		t.Fatal(err)
+	}
+
+	_, err = readEnvFile(envFile + ".none")
+	if err == nil {
+		t.Fatal()
+	}
+}
+
+func TestLoadEnvironment(t *testing.T) {
+	t.Setenv("GAZE_TEST_HOME", "/home/gaze")
+	envFile := createTempFile("*.env", "TOKEN=secret\nBIN=/opt/bin\nA=from_file\n")
+
+	commandConfig := &config.Command{
+		EnvFile:   []string{envFile},
+		Env:       map[string]string{"A": "1", "PATH_ADD": "$BIN:${GAZE_TEST_HOME}/bin", "B": "$A"},
+		ExpandEnv: true,
+	}
+	env, err := loadEnvironment(commandConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(env.list(), []string{"A=1", "B=from_file", "BIN=/opt/bin", "PATH_ADD=/opt/bin:/home/gaze/bin", "TOKEN=secret"}) {
+		t.Fatal(env.list())
+	}
+	if !reflect.DeepEqual(env.maskedList(), []string{"A=1", "B=from_file", "BIN=***", "PATH_ADD=/opt/bin:/home/gaze/bin", "TOKEN=***"}) {
+		t.Fatal(env.maskedList())
+	}
+
+	// Not expanded by default
+	commandConfig.ExpandEnv = false
+	env, _ = loadEnvironment(commandConfig)
+	if env.vars["B"] != "$A" {
+		t.Fatal(env.vars)
+	}
+
+	commandConfig.EnvFile = []string{envFile + ".none"}
+	_, err = loadEnvironment(commandConfig)
+	if err == nil {
+		t.Fatal()
+	}
+}
+
+func TestRenderCommandExpandEnv(t *testing.T) {
+	t.Setenv("GAZE_TEST_FLAGS", "-v")
+	commandConfig := &config.Command{Cmd: "go test $GAZE_TEST_FLAGS ${GAZE_TEST_RUN:-./...} {{file}}", Env: map[string]string{"GAZE_TEST_RUN": "./pkg/..."}}
+
+	env, err := loadEnvironment(commandConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := renderCommand(commandConfig, commandConfig.Cmd, "a$GAZE_TEST_FLAGS.go", nil, env)
+	if r != "go test $GAZE_TEST_FLAGS ${GAZE_TEST_RUN:-./...} a$GAZE_TEST_FLAGS.go" {
+		t.Fatal(r)
+	}
+
+	commandConfig.ExpandEnv = true
+	r, _ = renderCommand(commandConfig, commandConfig.Cmd, "a$GAZE_TEST_FLAGS.go", nil, env)
+	if r != "go test -v ./pkg/... a$GAZE_TEST_FLAGS.go" {
+		t.Fatal(r)
+	}
+}
+
+func TestRenderInvocationEnv(t *testing.T) {
+	envFile := createTempFile("*.env", "GAZE_TEST_FLAGS=-race\n")
+	commandConfig := &config.Command{Cmd: "go test $GAZE_TEST_FLAGS {{file}}", EnvFile: []string{envFile}, ExpandEnv: true}
+
+	// The same environment is used for the command and its process
+	inv := renderInvocation(commandConfig, "a.go", templateParams(commandConfig, "a.go", nil), 1000, false)
+	if inv == nil || !reflect.DeepEqual(inv.commandStringList, []string{"go test -race a.go"}) {
+		t.Fatal(inv)
+	}
+	if !reflect.DeepEqual(inv.options.env, []string{"GAZE_TEST_FLAGS=-race"}) {
+		t.Fatal(inv.options.env)
+	}
+
+	commandConfig.EnvFile = []string{envFile + ".none"}
+	if renderInvocation(commandConfig, "a.go", templateParams(commandConfig, "a.go", nil), 1000, false) != nil {
+		t.Fatal()
+	}
+}
@@ -8,18 +8,28 @@ package gazer
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/mattn/go-shellwords"
 	"github.com/wtetsu/gaze/pkg/config"
 	"github.com/wtetsu/gaze/pkg/gutil"
 	"github.com/wtetsu/gaze/pkg/logger"
 	"github.com/wtetsu/gaze/pkg/notify"
+	"github.com/wtetsu/gaze/pkg/uniq"
 )
 
 // Gazer gazes filesystem.
@@ -30,6 +40,24 @@ type Gazer struct {
 	invokeCount uint64
 	commands    commands
 	mutexes     sync.Map
+	batches     *batches
+	requeues    chan requeuedEvent
+	slots       *slots
+	groups      sync.Map // group name -> *slots
+	initialRun  bool
+	stopping    atomic.Bool // true while shutting down
+	keysEnabled bool
+	keys        *keyInput    // nil if keys are disabled
+	paused      bool         // File events are ignored while paused
+	lastFile    string       // The last file that ran commands
+	history     *uniq.Uniq   // Files that ran commands
+	clear       string       // Clear mode before each run. See config.ClearScreen
+	screen      io.Writer    // Terminal that clear clears
+	dispatched  atomic.Int32 // Runs dispatched and not finished yet
+	output      string       // Output mode of commands without their own. See config.OutputRaw
+
+	shutdownTimeoutMills int64            // Time to wait for the commands to exit when Gaze stops
+	shutdownSignal       <-chan os.Signal // Signals that stop Gaze. nil until Run starts
 }
 
 // New returns a new Gazer.
@@ -50,6 +78,13 @@ func New(patterns []string, maxWatchDirs int) (*Gazer, error) {
 		invokeCount: 0,
 		commands:    newCommands(),
 		mutexes:     sync.Map{},
+		batches:     newBatches(),
+		requeues:    make(chan requeuedEvent),
+		slots:       newSlots("a slot", 0),
+		history:     uniq.New(),
+		screen:      os.Stdout,
+
+		shutdownTimeoutMills: defaultShutdownTimeoutMills,
 	}, nil
 }
 
@@ -63,6 +98,39 @@ func (g *Gazer) Close() {
 	g.notify.Close()
 }
 
+// InitialRun sets whether matching commands run once at startup.
+func (g *Gazer) InitialRun(initialRun bool) {
+	g.initialRun = initialRun
+}
+
+// Keys sets whether keyboard controls are enabled. They are disabled anyway if stdin is not a terminal.
+func (g *Gazer) Keys(enabled bool) {
+	g.keysEnabled = enabled
+}
+
+// Clear sets how the terminal is cleared before each run (config.ClearScreen or config.ClearScrollback). Empty means no clear.
+func (g *Gazer) Clear(clear string) {
+	g.clear = clear
+}
+
+// Output sets the output mode of commands that do not have their own (config.OutputRaw, etc.).
+func (g *Gazer) Output(output string) {
+	g.output = output
+}
+
+// Jobs sets the maximum number of commands running at the same time. 0 means unlimited.
+func (g *Gazer) Jobs(jobs int) {
+	g.slots = newSlots("a slot", jobs)
+}
+
+// ShutdownTimeout sets the time(ms) to wait for the commands to exit when Gaze stops. 0 means 10 seconds.
+func (g *Gazer) ShutdownTimeout(timeoutMills int64) {
+	if timeoutMills <= 0 {
+		timeoutMills = defaultShutdownTimeoutMills
+	}
+	g.shutdownTimeoutMills = timeoutMills
+}
+
 // Run starts to gaze.
 func (g *Gazer) Run(configs *config.Config, timeoutMills int64, restart bool) error {
 	if timeoutMills <= 0 {
@@ -76,8 +144,24 @@ func (g *Gazer) Run(configs *config.Config, timeoutMills int64, restart bool) er
 // - Executes corresponding commands based on provided configuration
 // - Handles process restarts and timeouts if needed
 // - Gracefully shuts down upon receiving a SIGINT signal
+// - Handles keys if enabled
 func (g *Gazer) repeatRunAndWait(commandConfigs *config.Config, timeoutMills int64, restart bool) error {
-	sigInt := sigIntChannel()
+	shutdownSignal := shutdownSignalChannel()
+	defer signal.Stop(shutdownSignal)
+	g.shutdownSignal = shutdownSignal
+	defer g.batches.close()
+
+	if g.keysEnabled {
+		g.keys = startKeyInput()
+		if g.keys != nil {
+			defer g.keys.close()
+			logger.Notice(keysHelp)
+		}
+	}
+
+	if g.initialRun {
+		g.runInitially(commandConfigs, timeoutMills, restart)
+	}
 
 	isTerminated := false
 	for {
@@ -86,70 +170,491 @@ func (g *Gazer) repeatRunAndWait(commandConfigs *config.Config, timeoutMills int
 			if isTerminated {
 				break
 			}
+			if g.paused {
+				logger.Debug("Paused: %s", event.Name)
+				break
+			}
 			logger.Debug("Receive: %s", event.Name)
 
 			// This line is expected to not be executed concurrently by multiple threads.
 			g.handleEvent(commandConfigs, timeoutMills, restart, event)
 
-		case <-sigInt:
+		case requeued := <-g.requeues:
+			if isTerminated {
+				break
+			}
+			g.handleRequeue(commandConfigs, timeoutMills, restart, requeued)
+
+		case commandConfig := <-g.batches.flushes:
+			if isTerminated {
+				break
+			}
+			g.handleBatch(commandConfigs, timeoutMills, restart, commandConfig)
+
+		case key := <-g.keys.channel():
+			if isTerminated {
+				break
+			}
+			quit, err := g.handleKey(key, commandConfigs, timeoutMills, restart)
+			if quit {
+				isTerminated = true
+				return err
+			}
+
+		case sig := <-shutdownSignal:
 			isTerminated = true
-			return nil
+			return g.shutdown(sig)
 		}
 	}
 }
 
+// runInitially handles all the files matching the patterns as if they were updated.
+// Since all the events have the same time, each command runs only once.
+func (g *Gazer) runInitially(commandConfigs *config.Config, timeoutMills int64, restart bool) {
+	now := time.Now().UnixNano()
+	for _, filePath := range findTargetFiles(g.patterns) {
+		logger.Debug("Initial: %s", filePath)
+		g.handleEvent(commandConfigs, timeoutMills, restart, notify.Event{Name: filePath, Time: now})
+	}
+}
+
+// findTargetFiles returns the files matching the patterns. Files directly under a directory pattern are included.
+func findTargetFiles(patterns []string) []string {
+	targets := uniq.New()
+	for _, pattern := range patterns {
+		files, _ := gutil.Find(pattern)
+		if gutil.IsDir(pattern) {
+			filesInDir, _ := gutil.Find(filepath.Join(pattern, "*"))
+			files = append(files, filesInDir...)
+		}
+		for _, f := range files {
+			if gutil.IsFile(f) {
+				targets.Add(filepath.Clean(f))
+			}
+		}
+	}
+	return targets.List()
+}
+
 // handleEvent processes the received file system event.
 func (g *Gazer) handleEvent(config *config.Config, timeoutMills int64, restart bool, event notify.Event) {
-	commandStringList := g.tryToFindCommand(event.Name, config.Commands)
-	if commandStringList == nil {
+	commandConfigs := g.tryToFindCommands(event.Name, config.Commands, config.MatchAll)
+	if len(commandConfigs) > 0 {
+		g.lastFile = event.Name
+		g.history.Add(event.Name)
+	}
+
+	for _, commandConfig := range commandConfigs {
+		if commandConfig.Batch > 0 {
+			g.batches.add(commandConfig, event)
+			continue
+		}
+
+		inv := prepareInvocation(commandConfig, event.Name, timeoutMills, restart)
+		if inv == nil {
+			continue
+		}
+
+		if g.launchedAfter(inv, event) {
+			logger.Debug("Skip:%s, %d", inv.queueManageKey, event.Time)
+			continue
+		}
+		g.dispatch(inv, event, config.Log)
+	}
+}
+
+// launchedAfter returns true if the command has already launched after the event (e.g. initial run).
+// With "all", every file shares the key and has to run on its own, so it is always false.
+func (g *Gazer) launchedAfter(inv *invocation, event notify.Event) bool {
+	if inv.queuePolicy == config.QueueAll {
+		return false
+	}
+	return g.commands.lastLaunched(inv.queueManageKey) > event.Time
+}
+
+// handleRequeue processes an event that was queued while its command was running.
+// Only the command that queued the event runs.
+func (g *Gazer) handleRequeue(config *config.Config, timeoutMills int64, restart bool, requeued requeuedEvent) {
+	commandConfigs := g.tryToFindCommands(requeued.event.Name, config.Commands, config.MatchAll)
+
+	for _, commandConfig := range commandConfigs {
+		inv := prepareInvocation(commandConfig, requeued.event.Name, timeoutMills, restart)
+		if inv == nil || inv.queueManageKey != requeued.queueManageKey {
+			continue
+		}
+		if commandConfig.Batch > 0 {
+			// The files collected while the batch was queued run together
+			g.handleBatch(config, timeoutMills, restart, commandConfig)
+		} else {
+			g.dispatch(inv, requeued.event, config.Log)
+		}
 		return
 	}
+}
 
-	queueManageKey := strings.Join(commandStringList, "\n")
+// dispatch runs an invocation, or handles the event according to the queue policy if the same command is running.
+// Returns true if the invocation has been launched.
+func (g *Gazer) dispatch(inv *invocation, event notify.Event, logConfig *config.Log) bool {
+	queueManageKey := inv.queueManageKey
 
 	ongoingCommand := g.commands.get(queueManageKey)
 
-	if ongoingCommand != nil && restart {
-		kill(ongoingCommand.cmd, "Restart")
-		g.commands.update(queueManageKey, nil)
+	if ongoingCommand != nil {
+		if inv.restart {
+			g.stop(queueManageKey, "Restart")
+		} else if !g.handleBusy(inv, event) {
+			return false
+		}
 	}
 
-	if ongoingCommand != nil && !restart {
-		g.commands.enqueue(queueManageKey, event)
-		return
+	if inv.restart && inv.group != "" {
+		// A newer event in the group stops the other commands of the group
+		for _, key := range g.commands.keysInGroup(inv.group) {
+			if key != queueManageKey {
+				g.stop(key, "Restart")
+			}
+		}
 	}
 
 	mutex := g.lock(queueManageKey)
 
 	atomic.AddUint64(&g.invokeCount, 1)
+	g.commands.markLaunched(queueManageKey)
+	// The previous run of the same key has finished
+	inv.stopped.Store(false)
+	waiting := g.commands.wait(queueManageKey, inv.group, inv.stop, &inv.stopped)
+	// Runs dispatched while others are unfinished (e.g. match: all or -j) share the screen
+	inv.clear = g.dispatched.Add(1) == 1
 
 	go func() {
-		g.invoke(commandStringList, queueManageKey, timeoutMills, config.Log)
+		defer g.dispatched.Add(-1)
+		if g.acquire(inv, waiting) {
+			// It may have been canceled right before getting the slot
+			if g.commands.start(queueManageKey, waiting) {
+				g.invoke(inv, logConfig)
+			}
+			g.release(inv)
+		}
 		logger.Debug("Unlock: %s", queueManageKey)
 		mutex.Unlock()
 	}()
+	return true
+}
+
+// acquire waits until the command can run: first for its group, then for a global slot.
+func (g *Gazer) acquire(inv *invocation, waiting <-chan struct{}) bool {
+	if inv.group == "" {
+		return g.slots.acquire(inv.queueManageKey, waiting)
+	}
+	group := g.groupSlots(inv.group)
+	if !group.acquire(inv.queueManageKey, waiting) {
+		return false
+	}
+	if !g.slots.acquire(inv.queueManageKey, waiting) {
+		group.release()
+		return false
+	}
+	return true
+}
+
+func (g *Gazer) release(inv *invocation) {
+	g.slots.release()
+	if inv.group != "" {
+		g.groupSlots(inv.group).release()
+	}
+}
+
+// groupSlots returns the slot of the group. Commands in a group run one at a time.
+func (g *Gazer) groupSlots(group string) *slots {
+	s, _ := g.groups.LoadOrStore(group, newSlots("group "+group, 1))
+	return s.(*slots)
+}
+
+// stop kills the running command, or cancels it if it is still waiting for a slot.
+func (g *Gazer) stop(queueManageKey string, reason string) {
+	if g.commands.cancelWait(queueManageKey) {
+		logger.Info("%s: canceled while waiting: %s", reason, queueManageKey)
+		return
+	}
+	ongoingCommand := g.commands.markStopped(queueManageKey)
+	if ongoingCommand != nil {
+		terminate(ongoingCommand.proc, ongoingCommand.stop, reason)
+	}
+	g.commands.update(queueManageKey, nil)
 }
 
-func (g *Gazer) tryToFindCommand(filePath string, commandConfigs []config.Command) []string {
+// handleBusy handles an event for a running command. It returns true if the event should launch the command now.
+func (g *Gazer) handleBusy(inv *invocation, event notify.Event) bool {
+	queueManageKey := inv.queueManageKey
+
+	switch inv.queuePolicy {
+	case config.QueueAll:
+		g.commands.enqueueDistinct(queueManageKey, event)
+	case config.QueueDrop:
+		logger.Info("Drop: %s", event.Name)
+	case config.QueueCancel:
+		age := (time.Now().UnixNano() - g.commands.lastLaunched(queueManageKey)) / 1_000_000
+		ongoingCommand := g.commands.get(queueManageKey)
+		if age >= inv.cancelAfter && ongoingCommand != nil {
+			g.commands.clearQueue(queueManageKey)
+			g.stop(queueManageKey, "Cancel")
+			return true
+		}
+		g.commands.enqueue(queueManageKey, event)
+	default:
+		g.commands.enqueue(queueManageKey, event)
+	}
+	return false
+}
+
+// prepareInvocation renders a command for a file. Returns nil if the command cannot run.
+func prepareInvocation(commandConfig *config.Command, filePath string, timeoutMills int64, restart bool) *invocation {
+	params := templateParams(commandConfig, filePath, nil)
+	return renderInvocation(commandConfig, filePath, params, timeoutMills, restart)
+}
+
+// renderInvocation renders the commands with params and resolves their settings. Returns nil if the command cannot run.
+// The environment is loaded once for both.
+func renderInvocation(commandConfig *config.Command, filePath string, params map[string]interface{}, timeoutMills int64, restart bool) *invocation {
+	env, err := loadEnvironment(commandConfig)
+	if err != nil {
+		logger.NoticeObject(err)
+		return nil
+	}
+	commandStringList := renderCommandList(commandConfig, filePath, params, env)
+	if commandStringList == nil {
+		return nil
+	}
+
+	inv, err := newInvocation(commandConfig, commandStringList, filePath, params, env, timeoutMills, restart)
+	if err != nil {
+		logger.NoticeObject(err)
+		return nil
+	}
+	return inv
+}
+
+// invocation holds what is needed to run the commands for an event.
+type invocation struct {
+	commandStringList []string
+	queueManageKey    string
+	timeoutMills      int64
+	restart           bool
+	queuePolicy       string
+	cancelAfter       int64
+	group             string
+	steps             []config.Step // Failure policies of commandStringList. Empty for a newline-split cmd
+	retry             config.Retry
+	stop              stopOptions
+	options           commandOptions
+	output            string // Output mode of the command. Empty means the mode of Gazer
+	label             string // Label of the output with config.OutputPrefix
+	runLog            runLogOptions
+	clear             bool        // Clear the screen before the run. Only the first run of a dispatch batch clears
+	stopped           atomic.Bool // Set by stop. No more steps are launched except the ones that always run
+}
+
+// newInvocation resolves per-command settings. Unset ones fall back to the command line options.
+func newInvocation(commandConfig *config.Command, commandStringList []string, filePath string, params map[string]interface{}, env *environment, timeoutMills int64, restart bool) (*invocation, error) {
+	inv := &invocation{
+		commandStringList: commandStringList,
+		queueManageKey:    strings.Join(commandStringList, "\n"),
+		timeoutMills:      timeoutMills,
+		restart:           restart,
+		label:             outputLabel(commandConfig, commandStringList, filePath),
+	}
+	if commandConfig == nil {
+		return inv, nil
+	}
+
+	if commandConfig.Timeout > 0 {
+		inv.timeoutMills = commandConfig.Timeout
+	}
+	if commandConfig.Restart != nil {
+		inv.restart = *commandConfig.Restart
+	}
+	inv.queuePolicy = commandConfig.Queue
+	inv.cancelAfter = commandConfig.CancelAfter
+	inv.group = commandConfig.Group
+	inv.steps = commandConfig.Steps
+	inv.retry = commandConfig.Retry
+	inv.stop = newStopOptions(commandConfig.StopSignal, commandConfig.StopGraceMs)
+	if commandConfig.Cwd != "" {
+		dir, err := render(commandConfig.Cwd, filePath, params)
+		if err != nil {
+			return nil, err
+		}
+		inv.options.dir = dir
+		// The same command in different directories is managed separately
+		inv.queueManageKey = dir + "\n" + inv.queueManageKey
+	}
+	if commandConfig.Queue == config.QueueAll {
+		// Every file shares one FIFO
+		inv.queueManageKey = "queue\n" + inv.options.dir + "\n" + commandConfig.Template()
+	}
+	if commandConfig.Batch > 0 {
+		// Batched commands are managed by their template since the rendered command depends on the files
+		inv.queueManageKey = "batch\n" + inv.options.dir + "\n" + commandConfig.Template()
+	}
+	inv.options.env = env.list()
+	inv.options.envLog = env.maskedList()
+	inv.options.shell = commandConfig.Shell
+	inv.options.stdin = commandConfig.Stdin
+	// A command reading stdin uses the terminal of Gaze instead
+	inv.options.pty = commandConfig.Pty && !commandConfig.Stdin
+	inv.output = commandConfig.Output
+	inv.runLog = newRunLogOptions(commandConfig, filePath, params)
+	if commandConfig.Script {
+		inv.options.interpreter = scriptInterpreter(commandConfig)
+	}
+	return inv, nil
+}
+
+// outputLabel returns the label of the output: the name of the file, or the program for a batch.
+func outputLabel(commandConfig *config.Command, commandStringList []string, filePath string) string {
+	isBatch := commandConfig != nil && commandConfig.Batch > 0
+	if filePath != "" && !isBatch {
+		return filepath.Base(filePath)
+	}
+	if len(commandStringList) > 0 {
+		args, err := shellwords.Parse(commandStringList[0])
+		if err == nil && len(args) > 0 {
+			return filepath.Base(args[0])
+		}
+	}
+	return "gaze"
+}
+
+func toEnvList(env map[string]string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	envList := make([]string, 0, len(env))
+	for _, k := range keys {
+		envList = append(envList, k+"="+env[k])
+	}
+	return envList
+}
+
+func (g *Gazer) tryToFindCommands(filePath string, commandConfigs []config.Command, matchAll bool) []*config.Command {
 	if !matchAny(g.patterns, filePath) {
 		return nil
 	}
 
-	rawCommandString, err := getMatchedCommand(filePath, commandConfigs)
+	matched := findMatchedCommands(filePath, commandConfigs, matchAll)
+	if len(matched) == 0 {
+		logger.Debug("Command not found: %s", filePath)
+	}
+	return matched
+}
+
+// templateParams returns additional template parameters of a command.
+// - {{re.1}}, {{re.name}}, ...: capture groups of re
+// - {{files}}, {{count}}: batched files (if files is not nil)
+func templateParams(commandConfig *config.Command, filePath string, files []string) map[string]interface{} {
+	params := map[string]interface{}{}
+	captures, _ := commandConfig.Submatch(filePath)
+	if captures != nil {
+		params["re"] = captures
+	}
+	if files != nil {
+		params["files"] = fileList(files)
+		params["count"] = strconv.Itoa(len(files))
+	}
+	return params
+}
+
+func renderCommandList(commandConfig *config.Command, filePath string, params map[string]interface{}, env *environment) []string {
+	if len(commandConfig.Steps) > 0 {
+		return renderSteps(commandConfig, filePath, params, env)
+	}
+
+	rawCommandString, err := renderCommand(commandConfig, commandConfig.Cmd, filePath, params, env)
 	if err != nil {
 		logger.NoticeObject(err)
 		return nil
 	}
 
+	if commandConfig.Script {
+		// The whole block runs as one script
+		script := strings.TrimSpace(rawCommandString)
+		if script == "" {
+			logger.Debug("Command not found: %s", filePath)
+			return nil
+		}
+		return []string{script}
+	}
+
 	commandStringList := splitCommand(rawCommandString)
 	if len(commandStringList) == 0 {
 		logger.Debug("Command not found: %s", filePath)
 		return nil
 	}
+	return commandStringList
+}
 
+// renderSteps renders each step as a command.
+func renderSteps(commandConfig *config.Command, filePath string, params map[string]interface{}, env *environment) []string {
+	commandStringList := make([]string, len(commandConfig.Steps))
+	for i, step := range commandConfig.Steps {
+		commandString, err := renderCommand(commandConfig, step.Run, filePath, params, env)
+		if err != nil {
+			logger.NoticeObject(err)
+			return nil
+		}
+		commandStringList[i] = strings.TrimSpace(commandString)
+	}
 	return commandStringList
 }
 
+// renderCommand renders a command template. Values are quoted if the command runs in a shell.
+// With ExpandEnv, variables are expanded with env before rendering so that values from the file path are never expanded.
+// A shell expands variables by itself.
+func renderCommand(commandConfig *config.Command, sourceString string, filePath string, params map[string]interface{}, env *environment) (string, error) {
+	if runsInShell(commandConfig) {
+		return renderForShell(sourceString, filePath, params)
+	}
+	if commandConfig.ExpandEnv && !commandConfig.Script {
+		sourceString = expandEnv(sourceString, env.lookup)
+	}
+	return render(sourceString, filePath, params)
+}
+
+func runsInShell(commandConfig *config.Command) bool {
+	if commandConfig.Script {
+		return isShell(scriptInterpreter(commandConfig))
+	}
+	return commandConfig.Shell != ""
+}
+
+// scriptInterpreter returns the interpreter of a script: Interpreter, Shell or sh.
+func scriptInterpreter(commandConfig *config.Command) string {
+	if commandConfig.Interpreter != "" {
+		return commandConfig.Interpreter
+	}
+	if commandConfig.Shell != "" {
+		return resolveShell(commandConfig.Shell)
+	}
+	return "sh"
+}
+
+var shells = []string{"sh", "bash", "zsh", "dash", "ksh", "ash"}
+
+// isShell returns true if the interpreter is a POSIX-like shell.
+func isShell(interpreter string) bool {
+	args, err := shellwords.Parse(interpreter)
+	if err != nil || len(args) == 0 {
+		return false
+	}
+	return slices.Contains(shells, filepath.Base(args[0]))
+}
+
 func (g *Gazer) lock(queueManageKey string) *sync.Mutex {
 	logger.Debug("Lock: %s", queueManageKey)
 	mutex, ok := g.mutexes.Load(queueManageKey)
@@ -163,62 +668,222 @@ func (g *Gazer) lock(queueManageKey string) *sync.Mutex {
 }
 
 // invoke executes commands, handles timeouts, and processes queued events.
-func (g *Gazer) invoke(commandStringList []string, queueManageKey string, timeoutMills int64, logConfig *config.Log) {
+func (g *Gazer) invoke(inv *invocation, logConfig *config.Log) {
 	lastLaunched := time.Now().UnixNano()
 
-	commandSize := len(commandStringList)
+	output := newRunOutput(g.outputMode(inv), inv.label, inv.queueManageKey)
+	inv.options.output = output
+
+	runLog, err := openRunLog(inv.runLog)
+	if err != nil {
+		logger.Notice("Failed to keep the output: %v", err)
+	}
+	defer runLog.close()
+	inv.options.runLog = runLog
+
+	if g.clear != "" && inv.clear {
+		clearScreen(g.screen, g.clear == config.ClearScrollback)
+	}
+	logSeparator(output, logConfig, inv.commandStringList)
 
-	for i, commandString := range commandStringList {
-		logCommandStart(logConfig, commandString, commandSize, i)
+	commandSize := len(inv.commandStringList)
 
-		cmdResult := g.invokeOneCommand(commandString, queueManageKey, timeoutMills)
-		elapsed := cmdResult.EndTime.UnixNano() - cmdResult.StartTime.UnixNano()
-		logCommandEnd(logConfig, commandString, elapsed/1_000_000)
+	failed := false
+	for i, commandString := range inv.commandStringList {
+		if g.stopping.Load() {
+			break
+		}
+		step := inv.step(i)
+		if (failed || inv.stopped.Load()) && !step.Always {
+			logger.Info("Skip: %s", commandString)
+			continue
+		}
+		cmdResult := g.invokeWithRetry(commandString, inv, logConfig, commandSize, i)
 		if cmdResult.Err != nil {
 			if len(cmdResult.Err.Error()) > 0 {
-				logger.NoticeObject(cmdResult.Err)
+				output.log(func() { logger.NoticeObject(cmdResult.Err) })
+			}
+			if !step.ContinueOnError {
+				failed = true
 			}
-			break
 		}
 	}
+	output.flush()
+
 	// Handle waiting events
+	queueManageKey := inv.queueManageKey
 	queuedEvent := g.commands.dequeue(queueManageKey)
 	if queuedEvent == nil {
 		g.commands.update(queueManageKey, nil)
 	} else {
-		canAbolish := lastLaunched > queuedEvent.Time
+		// With "all", every queued file is processed even if it was updated before this launch
+		canAbolish := lastLaunched > queuedEvent.Time && inv.queuePolicy != config.QueueAll
 		if canAbolish {
 			logger.Debug("Abolish:%d, %d", lastLaunched, queuedEvent.Time)
 		} else {
 			// Requeue
 			g.commands.update(queueManageKey, nil)
-			g.notify.Requeue(*queuedEvent)
+			g.requeue(requeuedEvent{event: *queuedEvent, queueManageKey: queueManageKey})
 		}
 	}
 }
 
-func logCommandStart(logConfig *config.Log, commandString string, commandSize int, i int) {
-	params := makeCommonLogParams(commandString)
+// requeuedEvent is an event to be processed again by a specific command.
+type requeuedEvent struct {
+	event          notify.Event
+	queueManageKey string
+}
+
+// requeue passes an event to the main loop without blocking the caller.
+func (g *Gazer) requeue(requeued requeuedEvent) {
+	go func() {
+		g.requeues <- requeued
+	}()
+}
+
+// invokeWithRetry runs a command and retries it while it fails, as configured.
+// Retries are canceled when a newer event for the command arrives.
+func (g *Gazer) invokeWithRetry(commandString string, inv *invocation, logConfig *config.Log, commandSize int, i int) CmdResult {
+	output := inv.options.output
+	delayMills := inv.retry.DelayMs
+	for attempt := 1; ; attempt++ {
+		logCommandStart(output, logConfig, commandString, commandSize, i, attempt)
+		inv.options.runLog.start(commandString)
+		cmdResult := g.invokeOneCommand(commandString, inv, inv.step(i).Always)
+		inv.options.runLog.end(cmdResult)
+		logCommandEnd(output, logConfig, commandString, commandSize, i, attempt, cmdResult)
+		if cmdResult.Err == nil || attempt > inv.retry.Count || g.stopping.Load() || inv.stopped.Load() {
+			return cmdResult
+		}
+
+		ongoingCommand := g.commands.get(inv.queueManageKey)
+		if ongoingCommand == nil {
+			logger.Info("Retry canceled: %s", commandString)
+			return cmdResult
+		}
+		if len(cmdResult.Err.Error()) > 0 {
+			output.log(func() { logger.NoticeObject(cmdResult.Err) })
+		}
+		logger.Info("Retry in %dms: %s", delayMills, commandString)
+		if !g.waitForRetry(inv.queueManageKey, ongoingCommand.proc, delayMills) {
+			logger.Info("Retry canceled: %s", commandString)
+			return cmdResult
+		}
+		if inv.retry.Backoff > 0 {
+			delayMills = int64(float64(delayMills) * inv.retry.Backoff)
+		}
+	}
+}
+
+// waitForRetry waits for the delay. Returns false if a newer event arrives or the command is stopped.
+func (g *Gazer) waitForRetry(queueManageKey string, proc *process, delayMills int64) bool {
+	deadline := time.Now().Add(time.Duration(delayMills) * time.Millisecond)
+	for {
+		if g.commands.queued(queueManageKey) {
+			return false
+		}
+		ongoingCommand := g.commands.get(queueManageKey)
+		if ongoingCommand == nil || ongoingCommand.proc != proc {
+			return false
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return true
+		}
+		time.Sleep(min(remaining, 50*time.Millisecond))
+	}
+}
+
+// step returns the failure policy of the i-th command.
+func (inv *invocation) step(i int) config.Step {
+	if i < len(inv.steps) {
+		return inv.steps[i]
+	}
+	return config.Step{}
+}
+
+// outputMode returns the output mode of a run. A command reading stdin always writes the output as it is.
+func (g *Gazer) outputMode(inv *invocation) string {
+	if inv.options.stdin {
+		return config.OutputRaw
+	}
+	if inv.output != "" {
+		return inv.output
+	}
+	return g.output
+}
+
+// logSeparator prints the separator filled with "─" up to the terminal width.
+func logSeparator(output *runOutput, logConfig *config.Log, commandStringList []string) {
+	log := logConfig.RenderSeparator(makeCommonLogParams(strings.Join(commandStringList, "\n")))
+	if log == "" {
+		return
+	}
+	line := fillLine(log, terminalWidth())
+	output.log(func() { logger.NoticeWithBlank(line) })
+}
+
+const defaultTerminalWidth = 80
 
-	if commandSize >= 2 {
-		params["step"] = "(" + strconv.Itoa(i+1) + "/" + strconv.Itoa(commandSize) + ")"
+// fillLine fills a line with "─" up to width.
+func fillLine(s string, width int) string {
+	n := utf8.RuneCountInString(s)
+	if n >= width {
+		return s
 	}
+	return s + strings.Repeat("─", width-n)
+}
+
+// clearScreen clears the terminal. The scrollback is also cleared if scrollback is true.
+func clearScreen(w io.Writer, scrollback bool) {
+	if scrollback {
+		fmt.Fprint(w, "\033[H\033[2J\033[3J")
+		return
+	}
+	fmt.Fprint(w, "\033[H\033[2J")
+}
+
+func logCommandStart(output *runOutput, logConfig *config.Log, commandString string, commandSize int, i int, attempt int) {
+	params := makeCommonLogParams(commandString)
+	params["step"] = stepLabel(commandSize, i)
+	params["attempt"] = strconv.Itoa(attempt)
 
 	log := logConfig.RenderStart(params)
 	if log != "" {
-		logger.NoticeWithBlank(log)
+		output.log(func() { logger.NoticeWithBlank(log) })
 	}
 }
 
-func logCommandEnd(logConfig *config.Log, commandString string, elapsedMs int64) {
-	params := makeCommonLogParams(commandString)
-	params["elapsed_ms"] = strconv.FormatInt(elapsedMs, 10)
-	log := logConfig.RenderEnd(params)
+func logCommandEnd(output *runOutput, logConfig *config.Log, commandString string, commandSize int, i int, attempt int, cmdResult CmdResult) {
+	log := logConfig.RenderEnd(commandEndParams(commandString, commandSize, i, attempt, cmdResult))
 	if log != "" {
-		logger.Notice(log)
+		output.log(func() { logger.Notice(log) })
 	}
 }
 
+// commandEndParams returns the parameters of the end log. A result of each step is available.
+func commandEndParams(commandString string, commandSize int, i int, attempt int, cmdResult CmdResult) map[string]string {
+	params := makeCommonLogParams(commandString)
+	params["attempt"] = strconv.Itoa(attempt)
+	elapsed := cmdResult.EndTime.UnixNano() - cmdResult.StartTime.UnixNano()
+	params["elapsed_ms"] = strconv.FormatInt(elapsed/1_000_000, 10)
+	params["step"] = stepLabel(commandSize, i)
+	params["exit_code"] = strconv.Itoa(cmdResult.ExitCode)
+	params["status"] = "ok"
+	if cmdResult.Err != nil {
+		params["status"] = "failed"
+	}
+	return params
+}
+
+// stepLabel returns a label like "(1/3)". Empty for a single command.
+func stepLabel(commandSize int, i int) string {
+	if commandSize < 2 {
+		return ""
+	}
+	return "(" + strconv.Itoa(i+1) + "/" + strconv.Itoa(commandSize) + ")"
+}
+
 func makeCommonLogParams(makeCommonLogParams string) map[string]string {
 	now := time.Now()
 	return map[string]string{
@@ -233,10 +898,45 @@ func makeCommonLogParams(makeCommonLogParams string) map[string]string {
 	}
 }
 
-func (g *Gazer) invokeOneCommand(commandString string, queueManageKey string, timeoutMills int64) CmdResult {
-	cmd := createCommand(commandString)
-	g.commands.update(queueManageKey, cmd)
-	return executeCommandOrTimeout(cmd, timeoutMills)
+func (g *Gazer) invokeOneCommand(commandString string, inv *invocation, always bool) CmdResult {
+	if inv.options.stdin {
+		// The command reads the terminal instead of Gaze
+		g.keys.suspend()
+		defer g.keys.resume()
+	}
+	if inv.options.interpreter != "" {
+		return g.invokeScript(commandString, inv, always)
+	}
+	proc := newProcess(createCommand(commandString, inv.options))
+	return g.runProcess(proc, inv, always)
+}
+
+// invokeScript writes a script to a temporary file and runs it with the interpreter.
+func (g *Gazer) invokeScript(script string, inv *invocation, always bool) CmdResult {
+	scriptPath, err := writeScript(script)
+	if err != nil {
+		now := time.Now()
+		return CmdResult{StartTime: now, EndTime: now, Err: err, ExitCode: -1}
+	}
+	defer os.Remove(scriptPath)
+
+	proc := newProcess(createScriptCommand(scriptPath, inv.options))
+	return g.runProcess(proc, inv, always)
+}
+
+// runProcess registers the process so that stop can terminate it, and runs it.
+// Once the invocation has been stopped, only a step that always runs starts, without being registered.
+func (g *Gazer) runProcess(proc *process, inv *invocation, always bool) CmdResult {
+	if !inv.stopped.Load() {
+		g.commands.update(inv.queueManageKey, proc)
+	}
+	// Checked after the update since stop may have looked up the previous process
+	if inv.stopped.Load() && !always {
+		proc.discard()
+		now := time.Now()
+		return CmdResult{StartTime: now, EndTime: now, Err: errors.New(""), ExitCode: -1}
+	}
+	return executeCommandOrTimeout(proc, inv.timeoutMills, inv.stop)
 }
 
 func matchAny(watchFiles []string, s string) bool {
@@ -248,18 +948,21 @@ func matchAny(watchFiles []string, s string) bool {
 	return false
 }
 
-func getMatchedCommand(filePath string, commandConfigs []config.Command) (string, error) {
-	var result string
-	var resultError error
-	for _, c := range commandConfigs {
-		if c.Match(filePath) {
-			command, err := render(c.Cmd, filePath)
-			result = command
-			resultError = err
+// findMatchedCommands returns the first matching command.
+// If matchAll is true or a matching command has Continue, following matching commands are also returned.
+func findMatchedCommands(filePath string, commandConfigs []config.Command, matchAll bool) []*config.Command {
+	var matched []*config.Command
+	for i := range commandConfigs {
+		c := &commandConfigs[i]
+		if !c.Match(filePath) {
+			continue
+		}
+		matched = append(matched, c)
+		if !matchAll && !c.Continue {
 			break
 		}
 	}
-	return result, resultError
+	return matched
 }
 
 var newLines = regexp.MustCompile("\r\n|\n\r|\n|\r")
@@ -275,6 +978,87 @@ func splitCommand(commandString string) []string {
 	return commandList
 }
 
+const defaultShutdownTimeoutMills = 10 * 1000
+
+// ShutdownError is returned by Run when Gaze is stopped by a signal.
+type ShutdownError struct {
+	Signal    os.Signal
+	Unstopped int // Number of commands that did not exit in time
+}
+
+func (e *ShutdownError) Error() string {
+	if e.Unstopped > 0 {
+		return fmt.Sprintf("%v: %d command(s) did not exit in time", e.Signal, e.Unstopped)
+	}
+	return fmt.Sprintf("%v", e.Signal)
+}
+
+// ExitCode returns 128 + the signal number like a shell, or 1 if some commands did not exit.
+func (e *ShutdownError) ExitCode() int {
+	if e.Unstopped > 0 {
+		return 1
+	}
+	if s, ok := e.Signal.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// shutdown stops all the running commands with their stop signals and waits for them to exit.
+func (g *Gazer) shutdown(sig os.Signal) error {
+	g.stopping.Store(true)
+	unstopped := g.stopAll(fmt.Sprint(sig), g.shutdownSignal)
+	return &ShutdownError{Signal: sig, Unstopped: unstopped}
+}
+
+// stopAll stops all the running commands in parallel.
+// Returns the number of commands that did not exit within the shutdown timeout.
+// If another signal arrives while waiting, the commands are killed and stopAll returns immediately.
+func (g *Gazer) stopAll(reason string, signals <-chan os.Signal) int {
+	keys := g.commands.keys()
+	if len(keys) > 0 {
+		logger.Notice("%s: stopping %d command(s)", reason, len(keys))
+	}
+	// Kept here since stop removes the commands
+	var procs []*process
+	for _, key := range keys {
+		ongoingCommand := g.commands.get(key)
+		if ongoingCommand != nil && ongoingCommand.proc != nil {
+			procs = append(procs, ongoingCommand.proc)
+		}
+	}
+
+	var stopped atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, key := range keys {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				g.stop(key, reason)
+				stopped.Add(1)
+			}(key)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Duration(g.shutdownTimeoutMills) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		// Commands left in their grace period would outlive Gaze in their own process groups
+		logger.Notice("%s: killing the commands that did not exit within %dms", reason, g.shutdownTimeoutMills)
+		killAll(procs)
+	case sig := <-signals:
+		logger.Notice("%v: killing %d command(s)", sig, len(procs))
+		killAll(procs)
+	}
+	return len(keys) - int(stopped.Load())
+}
+
 // InvokeCount returns the current execution counter
 func (g *Gazer) InvokeCount() uint64 {
 	return atomic.LoadUint64(&g.invokeCount)
@@ -7,14 +7,21 @@
 package gazer
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/gutil"
+	"github.com/wtetsu/gaze/pkg/notify"
 )
 
 func TestBasic(t *testing.T) {
@@ -220,10 +227,10 @@ func TestKill(t *testing.T) {
 	pyKilled := false
 	rbKilled := false
 	for i := 0; i < 100; i++ {
-		if !pyKilled && kill(getCmd(&gazer.commands, py1Command), "test") {
+		if !pyKilled && terminate(getProcess(&gazer.commands, py1Command), stopOptions{}, "test") {
 			pyKilled = true
 		}
-		if !rbKilled && kill(getCmd(&gazer.commands, rb1Command), "test") {
+		if !rbKilled && terminate(getProcess(&gazer.commands, rb1Command), stopOptions{}, "test") {
 			rbKilled = true
 		}
 		if pyKilled && rbKilled {
@@ -237,13 +244,13 @@ func TestKill(t *testing.T) {
 	}
 }
 
-func getCmd(commands *commands, command string) *exec.Cmd {
+func getProcess(commands *commands, command string) *process {
 	c := commands.get(command)
 	if c == nil {
 		return nil
 	}
 
-	return c.cmd
+	return c.proc
 }
 
 func TestInvalidCommand(t *testing.T) {
@@ -262,8 +269,8 @@ func TestInvalidCommand(t *testing.T) {
 
 	var commandConfigs config.Config
 
-	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: ".rb", Cmd: "ruby {{file]]"})
-	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: ".py", Cmd: ""})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".rb"}, Cmd: "ruby {{file]]"})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: ""})
 
 	go gazer.Run(&commandConfigs, 10*1000, false)
 	if gazer.InvokeCount() != 0 {
@@ -287,21 +294,18 @@ func TestInvalidCommand(t *testing.T) {
 func TestGetAppropriateCommandOk(t *testing.T) {
 	var commandConfigs config.Config
 
-	var command string
-	var err error
-
-	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: "", Cmd: "echo"})
-	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: ".txt", Cmd: ""})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{""}, Cmd: "echo"})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".txt"}, Cmd: ""})
 
-	command, err = getMatchedCommand("a.txt", commandConfigs.Commands)
-	if command != "" || err != nil {
+	matched := findMatchedCommands("a.txt", commandConfigs.Commands, false)
+	if len(matched) != 1 || renderCommandList(matched[0], "a.txt", nil, &environment{}) != nil {
 		t.Fatal()
 	}
 
-	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: ".txt", Cmd: "echo"})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".txt"}, Cmd: "echo"})
 
-	command, err = getMatchedCommand("", commandConfigs.Commands)
-	if command == "a.txt" || err != nil {
+	matched = findMatchedCommands("", commandConfigs.Commands, false)
+	if len(matched) != 0 {
 		t.Fatal()
 	}
 }
@@ -309,23 +313,1107 @@ func TestGetAppropriateCommandOk(t *testing.T) {
 func TestGetAppropriateCommandError(t *testing.T) {
 	var commandConfigs config.Config
 
-	var command string
-	var err error
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".rb"}, Cmd: "ruby {{file]]"})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: "python {{file]]"})
+
+	if len(findMatchedCommands("a.txt", commandConfigs.Commands, false)) != 0 {
+		t.Fatal()
+	}
+
+	for _, filePath := range []string{"a.rb", "a.py"} {
+		matched := findMatchedCommands(filePath, commandConfigs.Commands, false)
+		if len(matched) != 1 {
+			t.Fatal(filePath)
+		}
+		command, err := renderCommand(matched[0], matched[0].Cmd, filePath, nil, &environment{})
+		if command != "" || err == nil {
+			t.Fatal(filePath)
+		}
+		if renderCommandList(matched[0], filePath, nil, &environment{}) != nil {
+			t.Fatal(filePath)
+		}
+	}
+}
+
+func TestNewInvocation(t *testing.T) {
+	commandStringList := []string{"go test"}
+
+	inv, err := newInvocation(&config.Command{Cmd: "go test"}, commandStringList, "pkg/a.go", nil, &environment{}, 1000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.timeoutMills != 1000 || inv.restart || inv.options.dir != "" || inv.options.env != nil || inv.queueManageKey != "go test" {
+		t.Fatalf("unexpected invocation: %+v", inv)
+	}
+
+	restart := true
+	commandConfig := &config.Command{
+		Cmd:     "go test",
+		Timeout: 50,
+		Restart: &restart,
+		Cwd:     "{{dir}}",
+		Env:     map[string]string{"B": "2", "A": "1"},
+	}
+	env, err := loadEnvironment(commandConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err = newInvocation(commandConfig, commandStringList, "pkg/a.go", nil, env, 1000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.timeoutMills != 50 || !inv.restart || inv.options.dir != "pkg" || inv.queueManageKey != "pkg\ngo test" {
+		t.Fatalf("unexpected invocation: %+v", inv)
+	}
+	if len(inv.options.env) != 2 || inv.options.env[0] != "A=1" || inv.options.env[1] != "B=2" {
+		t.Fatalf("unexpected env: %v", inv.options.env)
+	}
+
+	restart = false
+	inv, err = newInvocation(commandConfig, commandStringList, "pkg/a.go", nil, env, 1000, true)
+	if err != nil || inv.restart {
+		t.Fatal()
+	}
+
+	_, err = newInvocation(&config.Command{Cmd: "go test", Cwd: "{{dir"}, commandStringList, "pkg/a.go", nil, &environment{}, 1000, false)
+	if err == nil {
+		t.Fatal()
+	}
+}
+
+func TestCommandWorkingDirectory(t *testing.T) {
+	py1 := createTempFile("*.py", `import os; open("cwd.txt", "w").write(os.environ["GAZE_TEST"])`)
+	if py1 == "" {
+		t.Fatal("Temp files error")
+	}
+
+	gazer, _ := New([]string{py1}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	var commandConfigs config.Config
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{
+		Ext: []string{".py"},
+		Cmd: `python "{{base}}"`,
+		Cwd: "{{dir}}",
+		Env: map[string]string{"GAZE_TEST": "ok"},
+	})
+
+	go gazer.Run(&commandConfigs, 10*1000, false)
+
+	outFile := filepath.Join(filepath.Dir(py1), "cwd.txt")
+	for i := 0; i < 100; i++ {
+		touch(py1)
+		time.Sleep(50 * time.Millisecond)
+		b, err := os.ReadFile(outFile)
+		if err == nil && string(b) == "ok" {
+			return
+		}
+	}
+	t.Fatal()
+}
+
+func TestFindMatchedCommands(t *testing.T) {
+	commandConfigs := []config.Command{
+		{Ext: []string{".go"}, Cmd: "lint"},
+		{Ext: []string{".py"}, Cmd: "python"},
+		{Ext: []string{".go"}, Cmd: "test", Continue: true},
+		{Ext: []string{".go"}, Cmd: "build"},
+		{Ext: []string{".go"}, Cmd: "vet"},
+	}
+
+	toCmds := func(matched []*config.Command) string {
+		var list []string
+		for _, c := range matched {
+			list = append(list, c.Cmd)
+		}
+		return strings.Join(list, ",")
+	}
+
+	if r := toCmds(findMatchedCommands("a.go", commandConfigs, false)); r != "lint" {
+		t.Fatal(r)
+	}
+	if r := toCmds(findMatchedCommands("a.go", commandConfigs, true)); r != "lint,test,build,vet" {
+		t.Fatal(r)
+	}
+	if r := toCmds(findMatchedCommands("a.go", commandConfigs[2:], false)); r != "test,build" {
+		t.Fatal(r)
+	}
+	if r := toCmds(findMatchedCommands("a.rb", commandConfigs, true)); r != "" {
+		t.Fatal(r)
+	}
+}
+
+func TestRenderCommandListWithCaptures(t *testing.T) {
+	rawCfg := `extends: none
+commands:
+- re: ^services/(?P<svc>[^/]+)/
+  cmd: make -C services/{{re.svc}} test {{re.1}}
+  cwd: services/{{re.svc}}
+`
+	yml := createTempFile("*.yml", rawCfg)
+	c, err := config.LoadConfigFromFile(yml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commandConfig := &c.Commands[0]
+
+	params := templateParams(commandConfig, "services/billing/main.go", nil)
+	commandStringList := renderCommandList(commandConfig, "services/billing/main.go", params, &environment{})
+	if len(commandStringList) != 1 || commandStringList[0] != "make -C services/billing test billing" {
+		t.Fatal(commandStringList)
+	}
+
+	inv, err := newInvocation(commandConfig, commandStringList, "services/billing/main.go", params, &environment{}, 1000, false)
+	if err != nil || inv.options.dir != "services/billing" {
+		t.Fatal(inv, err)
+	}
+
+	matched := findMatchedCommands("services/auth/a.go", c.Commands, false)
+	if len(matched) != 1 {
+		t.Fatal(matched)
+	}
+	params = templateParams(matched[0], "services/auth/a.go", nil)
+	commandStringList = renderCommandList(matched[0], "services/auth/a.go", params, &environment{})
+	if len(commandStringList) != 1 || commandStringList[0] != "make -C services/auth test auth" {
+		t.Fatal(commandStringList)
+	}
+}
+
+func TestMatchAll(t *testing.T) {
+	f := newFixture(t)
+
+	gazer, _ := New([]string{f.py1}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	commandConfigs := config.Config{MatchAll: true}
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: f.record("one")})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: f.record("two")})
+
+	go gazer.Run(&commandConfigs, 10*1000, false)
+	emit(gazer, notify.Event{Name: f.py1, Time: time.Now().UnixNano()})
+
+	lines := f.waitForLines(t, gazer, 2)
+	if len(lines) != 2 || !slices.Contains(lines, "one") || !slices.Contains(lines, "two") {
+		t.Fatal(lines)
+	}
+}
+
+func TestFindTargetFiles(t *testing.T) {
+	py1 := createTempFile("*.py", `#`)
+	dir := filepath.Dir(py1)
+	rb1 := filepath.Join(dir, "a.rb")
+	os.WriteFile(rb1, []byte("#"), 0644)
+	os.MkdirAll(filepath.Join(dir, "sub"), os.ModePerm)
+
+	files := findTargetFiles([]string{filepath.Join(dir, "*.py"), py1})
+	if len(files) != 1 || files[0] != filepath.Clean(py1) {
+		t.Fatal(files)
+	}
+	files = findTargetFiles([]string{dir})
+	if len(files) != 2 {
+		t.Fatal(files)
+	}
+	if len(findTargetFiles([]string{filepath.Join(dir, "*.none")})) != 0 {
+		t.Fatal()
+	}
+}
+
+func TestInitialRun(t *testing.T) {
+	f := newFixture(t)
+
+	gazer, _ := New([]string{filepath.Join(f.dir, "*.py")}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	commandConfigs := config.Config{MatchAll: true}
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: f.record(`"{{base}}"`)})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: f.record("all")})
+
+	gazer.InitialRun(true)
+	go gazer.Run(&commandConfigs, 10*1000, false)
+
+	// Each file once for the command per file, and once for the command without {{file}}
+	lines := f.waitForLines(t, gazer, 3)
+	slices.Sort(lines)
+	if !slices.Equal(lines, []string{"all", "first.py", "second.py"}) {
+		t.Fatal(lines)
+	}
+}
+
+func TestQueuePolicies(t *testing.T) {
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	key := "key01"
+	busy := func() {
+		gazer.commands.update(key, newProcess(nil))
+		gazer.commands.markLaunched(key)
+	}
+	queued := func() []string {
+		var names []string
+		for e := gazer.commands.dequeue(key); e != nil; e = gazer.commands.dequeue(key) {
+			names = append(names, e.Name)
+		}
+		return names
+	}
+	a := notify.Event{Name: "a.py", Time: 1}
+	b := notify.Event{Name: "b.py", Time: 2}
+
+	// coalesce (default)
+	busy()
+	inv := &invocation{queueManageKey: key}
+	if gazer.handleBusy(inv, a) || gazer.handleBusy(inv, b) {
+		t.Fatal()
+	}
+	if names := queued(); len(names) != 1 || names[0] != "b.py" {
+		t.Fatal(names)
+	}
+
+	// all
+	busy()
+	inv = &invocation{queueManageKey: key, queuePolicy: config.QueueAll}
+	gazer.handleBusy(inv, a)
+	gazer.handleBusy(inv, b)
+	gazer.handleBusy(inv, a)
+	if names := queued(); len(names) != 2 || names[0] != "a.py" || names[1] != "b.py" {
+		t.Fatal(names)
+	}
+
+	// drop
+	busy()
+	inv = &invocation{queueManageKey: key, queuePolicy: config.QueueDrop}
+	if gazer.handleBusy(inv, a) {
+		t.Fatal()
+	}
+	if names := queued(); len(names) != 0 {
+		t.Fatal(names)
+	}
+
+	// cancel: the run is younger than cancel_after
+	busy()
+	inv = &invocation{queueManageKey: key, queuePolicy: config.QueueCancel, cancelAfter: 60 * 1000}
+	if gazer.handleBusy(inv, a) {
+		t.Fatal()
+	}
+	if names := queued(); len(names) != 1 || names[0] != "a.py" {
+		t.Fatal(names)
+	}
+
+	// cancel: the run is older than cancel_after
+	busy()
+	time.Sleep(20 * time.Millisecond)
+	inv = &invocation{queueManageKey: key, queuePolicy: config.QueueCancel, cancelAfter: 10}
+	gazer.commands.enqueue(key, a)
+	if !gazer.handleBusy(inv, b) {
+		t.Fatal()
+	}
+	if gazer.commands.get(key) != nil {
+		t.Fatal()
+	}
+	if names := queued(); len(names) != 0 {
+		t.Fatal(names)
+	}
+}
+
+func TestQueueAll(t *testing.T) {
+	f := newFixture(t)
+
+	gazer, _ := New([]string{filepath.Join(f.dir, "*.py")}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	var commandConfigs config.Config
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{
+		Ext:   []string{".py"},
+		Cmd:   f.record(`"{{base}}" 0.3`),
+		Queue: config.QueueAll,
+	})
+
+	go gazer.Run(&commandConfigs, 10*1000, false)
+
+	// Update both files while the first run is still running
+	emit(gazer, notify.Event{Name: f.py1, Time: time.Now().UnixNano()})
+	waitFor(t, func() bool { return len(f.lines()) > 0 })
+	emit(gazer, notify.Event{Name: f.py2, Time: time.Now().UnixNano()}, notify.Event{Name: f.py1, Time: time.Now().UnixNano()})
+
+	lines := f.waitForLines(t, gazer, 6)
+	if !slices.Equal(lines, []string{"first.py", "end", "second.py", "end", "first.py", "end"}) {
+		t.Fatal(lines)
+	}
+}
+
+func TestQueueAllBurst(t *testing.T) {
+	f := newFixture(t)
+
+	gazer, _ := New([]string{filepath.Join(f.dir, "*.py")}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	var commandConfigs config.Config
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{
+		Ext:   []string{".py"},
+		Cmd:   f.record(`"{{base}}"`),
+		Queue: config.QueueAll,
+	})
+
+	// Files saved at once run one by one, even though they have the same time
+	gazer.InitialRun(true)
+	go gazer.Run(&commandConfigs, 10*1000, false)
+	lines := f.waitForLines(t, gazer, 2)
+	slices.Sort(lines)
+	if !slices.Equal(lines, []string{"first.py", "second.py"}) {
+		t.Fatal(lines)
+	}
+
+	third := filepath.Join(f.dir, "third.py")
+	os.WriteFile(third, []byte("#"), 0o644)
+	now := time.Now().UnixNano()
+	emit(gazer, notify.Event{Name: f.py2, Time: now}, notify.Event{Name: third, Time: now}, notify.Event{Name: f.py1, Time: now})
+	lines = f.waitForLines(t, gazer, 5)
+	if !slices.Equal(lines[2:], []string{"second.py", "third.py", "first.py"}) {
+		t.Fatal(lines)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	f := newFixture(t)
+
+	gazer, _ := New([]string{filepath.Join(f.dir, "*.py")}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	var commandConfigs config.Config
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: f.record(`"{{base}}" 0.3`)})
+
+	gazer.Jobs(1)
+	go gazer.Run(&commandConfigs, 10*1000, false)
+	now := time.Now().UnixNano()
+	emit(gazer, notify.Event{Name: f.py1, Time: now}, notify.Event{Name: f.py2, Time: now})
+
+	// The second run starts after the first one ends
+	lines := f.waitForLines(t, gazer, 4)
+	if len(lines) != 4 || lines[1] != "end" || lines[3] != "end" || lines[0] == lines[2] {
+		t.Fatal(lines)
+	}
+}
+
+// clearCounter counts how many times the screen is cleared.
+type clearCounter struct {
+	mutex sync.Mutex
+	count int
+}
+
+func (c *clearCounter) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.count += strings.Count(string(p), "\033[2J")
+	return len(p), nil
+}
+
+func (c *clearCounter) get() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.count
+}
+
+func TestClearOncePerDispatch(t *testing.T) {
+	f := newFixture(t)
+
+	gazer, _ := New([]string{filepath.Join(f.dir, "*.py")}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+	screen := &clearCounter{}
+	gazer.screen = screen
+
+	commandConfigs := config.Config{MatchAll: true}
+	for _, name := range []string{"a", "b", "c"} {
+		commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: f.record(name + " 0.2")})
+	}
+
+	gazer.Jobs(2)
+	gazer.Clear(config.ClearScreen)
+	go gazer.Run(&commandConfigs, 10*1000, false)
+
+	// The third command waits for a slot and does not clear the output of the others
+	emit(gazer, notify.Event{Name: f.py1, Time: time.Now().UnixNano()})
+	f.waitForLines(t, gazer, 6)
+	waitFor(t, func() bool { return gazer.dispatched.Load() == 0 })
+	if screen.get() != 1 {
+		t.Fatal(screen.get())
+	}
+
+	emit(gazer, notify.Event{Name: f.py1, Time: time.Now().UnixNano()})
+	f.waitForLines(t, gazer, 12)
+	if screen.get() != 2 {
+		t.Fatal(screen.get())
+	}
+}
+
+func TestGroup(t *testing.T) {
+	f := newFixture(t)
+
+	gazer, _ := New([]string{filepath.Join(f.dir, "*.py")}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	commandConfigs := config.Config{MatchAll: true}
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: f.record("build 0.3"), Group: "cache"})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: f.record("test 0.3"), Group: "cache"})
+
+	go gazer.Run(&commandConfigs, 10*1000, false)
+	emit(gazer, notify.Event{Name: f.py1, Time: time.Now().UnixNano()})
+
+	// The commands of a group run one at a time
+	lines := f.waitForLines(t, gazer, 4)
+	if len(lines) != 4 || lines[1] != "end" || lines[3] != "end" || lines[0] == lines[2] {
+		t.Fatal(lines)
+	}
+}
+
+func TestGroupRestart(t *testing.T) {
+	f := newFixture(t)
+	txt := filepath.Join(f.dir, "data.txt")
+	os.WriteFile(txt, []byte("#"), 0644)
+
+	gazer, _ := New([]string{filepath.Join(f.dir, "*")}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	restart := true
+	var commandConfigs config.Config
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".py"}, Cmd: f.record("slow 5"), Group: "db", Restart: &restart})
+	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: []string{".txt"}, Cmd: f.record("fast 0"), Group: "db", Restart: &restart})
 
-	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: ".rb", Cmd: "ruby {{file]]"})
-	commandConfigs.Commands = append(commandConfigs.Commands, config.Command{Ext: ".py", Cmd: "python {{file]]"})
+	go gazer.Run(&commandConfigs, 10*1000, false)
+	emit(gazer, notify.Event{Name: f.py1, Time: time.Now().UnixNano()})
+	waitFor(t, func() bool { return len(f.lines()) > 0 })
+	emit(gazer, notify.Event{Name: txt, Time: time.Now().UnixNano()})
+
+	// The slow command is stopped before it ends
+	lines := f.waitForLines(t, gazer, 3)
+	if !slices.Equal(lines, []string{"slow", "fast", "end"}) {
+		t.Fatal(lines)
+	}
+}
+
+func TestShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	dir, _ := os.MkdirTemp("", "gaze it's")
+	py1 := filepath.Join(dir, "a $HOME.py")
+	os.WriteFile(py1, []byte("#"), 0644)
+
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	commandConfig := &config.Command{
+		Ext:   []string{".py"},
+		Cmd:   `echo "{{base}}" | tr a-z A-Z > "{{dir}}/out.txt" && cat {{file}} >> '{{dir}}/out.txt'`,
+		Shell: "sh",
+	}
+	inv := prepareInvocation(commandConfig, py1, 10*1000, false)
+	if inv == nil {
+		t.Fatal()
+	}
+	gazer.invoke(inv, nil)
+
+	b, _ := os.ReadFile(filepath.Join(dir, "out.txt"))
+	if string(b) != "A $HOME.PY\n#" {
+		t.Fatalf("%q", b)
+	}
+}
+
+func TestScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	py1 := createTempFile("*.py", `#`)
+	if py1 == "" {
+		t.Fatal("Temp files error")
+	}
+	dir := filepath.Dir(py1)
+
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	// cd, variables and functions carry over to the following lines
+	commandConfig := &config.Command{
+		Ext:    []string{".py"},
+		Cmd:    "cd {{dir}}\nNAME={{base}}\nhello() { echo \"hello $1\"; }\nhello \"$NAME\" > out.txt",
+		Script: true,
+	}
+	inv := prepareInvocation(commandConfig, py1, 10*1000, false)
+	if inv == nil || len(inv.commandStringList) != 1 || inv.options.interpreter != "sh" {
+		t.Fatal(inv)
+	}
+	cmdResult := gazer.invokeOneCommand(inv.commandStringList[0], inv, false)
+	if cmdResult.Err != nil {
+		t.Fatal(cmdResult.Err)
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "out.txt"))
+	if string(b) != "hello "+filepath.Base(py1)+"\n" {
+		t.Fatalf("%q", b)
+	}
+
+	// Another interpreter
+	commandConfig = &config.Command{
+		Ext:         []string{".py"},
+		Cmd:         "import os\nos.chdir(\"{{dir}}\")\nopen(\"out.txt\", \"w\").write(\"{{base}}\")\nraise SystemExit(3)",
+		Script:      true,
+		Interpreter: "python",
+	}
+	inv = prepareInvocation(commandConfig, py1, 10*1000, false)
+	cmdResult = gazer.invokeOneCommand(inv.commandStringList[0], inv, false)
+	if cmdResult.ExitCode != 3 {
+		t.Fatal(cmdResult)
+	}
+	b, _ = os.ReadFile(filepath.Join(dir, "out.txt"))
+	if string(b) != filepath.Base(py1) {
+		t.Fatalf("%q", b)
+	}
+}
+
+func TestScriptInterpreter(t *testing.T) {
+	testCases := []struct {
+		command     config.Command
+		interpreter string
+		shell       bool
+	}{
+		{config.Command{Script: true}, "sh", true},
+		{config.Command{Script: true, Shell: "bash"}, "bash", true},
+		{config.Command{Script: true, Interpreter: "/bin/bash -euo pipefail"}, "/bin/bash -euo pipefail", true},
+		{config.Command{Script: true, Interpreter: "python"}, "python", false},
+		{config.Command{Shell: "zsh"}, "", true},
+		{config.Command{}, "", false},
+	}
+	for _, tc := range testCases {
+		inv, _ := newInvocation(&tc.command, []string{"ls"}, "a.py", nil, &environment{}, 1000, false)
+		if inv.options.interpreter != tc.interpreter || runsInShell(&tc.command) != tc.shell {
+			t.Fatalf("%+v: %+v", tc.command, inv.options)
+		}
+	}
+}
+
+func TestSteps(t *testing.T) {
+	py1 := createTempFile("*.py", `#`)
+	if py1 == "" {
+		t.Fatal("Temp files error")
+	}
+	dir := filepath.Dir(py1)
+	script := filepath.Join(dir, "step.py")
+	os.WriteFile(script, []byte(`import sys; open(sys.argv[1], "a").write(sys.argv[2] + "\n"); sys.exit(int(sys.argv[3]))`), 0644)
+	out := filepath.Join(dir, "out.log")
+	step := `python "` + script + `" "` + out + `" `
+
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	commandConfig := &config.Command{
+		Ext: []string{".py"},
+		Steps: []config.Step{
+			{Run: step + "lint 1", ContinueOnError: true},
+			{Run: step + "{{base}} 1"},
+			{Run: step + "skipped 0"},
+			{Run: step + "cleanup 0", Always: true},
+		},
+	}
+	inv := prepareInvocation(commandConfig, py1, 10*1000, false)
+	if inv == nil || len(inv.commandStringList) != 4 || !strings.Contains(inv.commandStringList[1], filepath.Base(py1)) {
+		t.Fatal(inv)
+	}
+	gazer.invoke(inv, nil)
+
+	b, _ := os.ReadFile(out)
+	if string(b) != "lint\n"+filepath.Base(py1)+"\ncleanup\n" {
+		t.Fatalf("%q", b)
+	}
+
+	// Newline-split commands stop at the first failure
+	os.Remove(out)
+	inv = prepareInvocation(&config.Command{Ext: []string{".py"}, Cmd: step + "a 1\n" + step + "b 0"}, py1, 10*1000, false)
+	gazer.invoke(inv, nil)
+	b, _ = os.ReadFile(out)
+	if string(b) != "a\n" {
+		t.Fatalf("%q", b)
+	}
+}
+
+func TestStopSkipsSteps(t *testing.T) {
+	f := newFixture(t)
+
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	commandConfig := &config.Command{
+		Ext: []string{".py"},
+		Steps: []config.Step{
+			{Run: f.record("first 60"), ContinueOnError: true},
+			{Run: f.record("second")},
+			{Run: f.record("cleanup"), Always: true},
+		},
+	}
+	inv := prepareInvocation(commandConfig, f.py1, 60*1000, false)
+	gazer.dispatch(inv, notify.Event{Name: f.py1, Time: time.Now().UnixNano()}, nil)
+	waitFor(t, func() bool { return len(f.lines()) == 1 })
+
+	// Only the step that always runs follows the stopped one
+	gazer.stop(inv.queueManageKey, "test")
+	waitFor(t, func() bool { return gazer.dispatched.Load() == 0 })
+	if lines := f.lines(); !slices.Equal(lines, []string{"first", "cleanup"}) {
+		t.Fatal(lines)
+	}
+}
+
+func TestCommandEndParams(t *testing.T) {
+	start := time.Now()
+	params := commandEndParams("ls", 3, 1, 2, CmdResult{StartTime: start, EndTime: start.Add(1500 * time.Millisecond), Err: errors.New("exitCode:2"), ExitCode: 2})
+	if params["command"] != "ls" || params["elapsed_ms"] != "1500" || params["step"] != "(2/3)" || params["status"] != "failed" || params["exit_code"] != "2" || params["attempt"] != "2" {
+		t.Fatal(params)
+	}
+	params = commandEndParams("ls", 1, 0, 1, CmdResult{StartTime: start, EndTime: start})
+	if params["step"] != "" || params["status"] != "ok" || params["exit_code"] != "0" {
+		t.Fatal(params)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	py1 := createTempFile("*.py", `#`)
+	if py1 == "" {
+		t.Fatal("Temp files error")
+	}
+	dir := filepath.Dir(py1)
+	// Fails until it has run argv[2] times
+	script := filepath.Join(dir, "flaky.py")
+	os.WriteFile(script, []byte(`import sys; f = open(sys.argv[1], "a"); f.write("x"); f.close(); sys.exit(0 if len(open(sys.argv[1]).read()) >= int(sys.argv[2]) else 1)`), 0644)
+	out := filepath.Join(dir, "out.log")
+
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	commandConfig := &config.Command{
+		Ext:   []string{".py"},
+		Cmd:   `python "` + script + `" "` + out + `" 3`,
+		Retry: config.Retry{Count: 2, DelayMs: 100, Backoff: 2},
+	}
+	inv := prepareInvocation(commandConfig, py1, 10*1000, false)
+	start := time.Now()
+	cmdResult := gazer.invokeWithRetry(inv.commandStringList[0], inv, nil, 1, 0)
+	if cmdResult.Err != nil {
+		t.Fatal(cmdResult.Err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	b, _ := os.ReadFile(out)
+	if string(b) != "xxx" {
+		t.Fatalf("%q", b)
+	}
+
+	// Not enough retries
+	os.Remove(out)
+	commandConfig.Retry = config.Retry{Count: 1}
+	inv = prepareInvocation(commandConfig, py1, 10*1000, false)
+	cmdResult = gazer.invokeWithRetry(inv.commandStringList[0], inv, nil, 1, 0)
+	if cmdResult.Err == nil {
+		t.Fatal()
+	}
+	b, _ = os.ReadFile(out)
+	if string(b) != "xx" {
+		t.Fatalf("%q", b)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	commandConfig := &config.Command{
+		Ext:   []string{".py"},
+		Cmd:   `python -c "import sys; sys.exit(1)"`,
+		Retry: config.Retry{Count: 5, DelayMs: 10 * 1000},
+	}
+	inv := prepareInvocation(commandConfig, "a.py", 10*1000, false)
+
+	done := make(chan CmdResult)
+	go func() {
+		done <- gazer.invokeWithRetry(inv.commandStringList[0], inv, nil, 1, 0)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	gazer.commands.enqueue(inv.queueManageKey, notify.Event{Name: "a.py", Time: time.Now().UnixNano()})
+
+	select {
+	case cmdResult := <-done:
+		if cmdResult.Err == nil {
+			t.Fatal()
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("retry was not canceled")
+	}
+}
+
+func TestWaitForRetry(t *testing.T) {
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	key := "key01"
+	proc := newProcess(nil)
+	gazer.commands.update(key, proc)
+	if !gazer.waitForRetry(key, proc, 10) {
+		t.Fatal()
+	}
+
+	newProc := newProcess(nil)
+	gazer.commands.update(key, newProc)
+	if gazer.waitForRetry(key, proc, 10) {
+		t.Fatal()
+	}
+
+	gazer.commands.enqueue(key, notify.Event{Name: "a.py", Time: 1})
+	if gazer.waitForRetry(key, newProc, 10) {
+		t.Fatal()
+	}
+}
+
+func TestRestartWaitsForExit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	ready := createTempFile("*.txt", "")
+	os.Remove(ready)
+
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	restart := true
+	commandConfig := &config.Command{
+		Ext:         []string{".py"},
+		Cmd:         `python -c "import signal, sys, time; signal.signal(signal.SIGTERM, signal.SIG_IGN); open(sys.argv[1], 'w').close(); time.sleep(30)" "` + ready + `"`,
+		Restart:     &restart,
+		StopGraceMs: 300,
+	}
+	inv := prepareInvocation(commandConfig, "a.py", 60*1000, false)
+	if inv.stop.graceMills != 300 {
+		t.Fatal(inv.stop)
+	}
+	gazer.dispatch(inv, notify.Event{Name: "a.py", Time: time.Now().UnixNano()}, nil)
+
+	var first *process
+	for i := 0; i < 200; i++ {
+		time.Sleep(20 * time.Millisecond)
+		first = getProcess(&gazer.commands, inv.queueManageKey)
+		if first != nil && gutil.IsFile(ready) {
+			break
+		}
+	}
+	if first == nil || !gutil.IsFile(ready) {
+		t.Fatal("not started")
+	}
+
+	// The second dispatch returns after the first process has exited
+	gazer.dispatch(inv, notify.Event{Name: "a.py", Time: time.Now().UnixNano()}, nil)
+	if !hasExited(first) {
+		t.Fatal()
+	}
+
+	for i := 0; i < 200; i++ {
+		time.Sleep(20 * time.Millisecond)
+		second := getProcess(&gazer.commands, inv.queueManageKey)
+		if second != nil && second != first && second.started() != nil {
+			terminate(second, stopOptions{signal: syscall.SIGKILL}, "test")
+			return
+		}
+	}
+	t.Fatal("not restarted")
+}
+
+// ignoringSigtermCommand returns a command that ignores SIGTERM, and a file created when it is ready.
+func ignoringSigtermCommand() (string, string) {
+	ready := createTempFile("*.txt", "")
+	os.Remove(ready)
+	return `python -c "import signal, sys, time; signal.signal(signal.SIGTERM, signal.SIG_IGN); open(sys.argv[1], 'w').close(); time.sleep(30)" "` + ready + `"`, ready
+}
+
+func waitForFile(t *testing.T, filePath string) {
+	t.Helper()
+	waitFor(t, func() bool { return gutil.IsFile(filePath) })
+}
+
+// waitFor waits until cond returns true. The test fails after 10 seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recordScript appends argv[2] to argv[1]. With argv[3], it sleeps for argv[3] seconds and appends "end".
+const recordScript = `import sys, time
+f = open(sys.argv[1], "a")
+f.write(sys.argv[2] + "\n")
+f.flush()
+if len(sys.argv) > 3:
+    time.sleep(float(sys.argv[3]))
+    f.write("end\n")
+`
+
+// fixture is a temporary directory with two Python files to watch and a script that records runs to out.log.
+type fixture struct {
+	dir    string
+	py1    string // first.py
+	py2    string // second.py
+	script string // The script is in a subdirectory so that it does not match dir/*.py
+	out    string
+}
+
+func newFixture(t *testing.T) *fixture {
+	dir := t.TempDir()
+	f := &fixture{
+		dir:    dir,
+		py1:    filepath.Join(dir, "first.py"),
+		py2:    filepath.Join(dir, "second.py"),
+		script: filepath.Join(dir, "scripts", "record.py"),
+		out:    filepath.Join(dir, "out.log"),
+	}
+	os.Mkdir(filepath.Dir(f.script), 0o755)
+	for _, p := range []string{f.py1, f.py2} {
+		os.WriteFile(p, []byte("#"), 0o644)
+	}
+	err := os.WriteFile(f.script, []byte(recordScript), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// record returns a command that records args to out.log.
+func (f *fixture) record(args string) string {
+	return `python "` + f.script + `" "` + f.out + `" ` + args
+}
+
+// lines returns the lines recorded so far.
+func (f *fixture) lines() []string {
+	b, _ := os.ReadFile(f.out)
+	return strings.Fields(string(b))
+}
+
+// waitForLines waits until n lines are recorded and no command is running, and returns the lines.
+func (f *fixture) waitForLines(t *testing.T, gazer *Gazer, n int) []string {
+	t.Helper()
+	waitFor(t, func() bool { return len(f.lines()) >= n && len(gazer.commands.keys()) == 0 })
+	return f.lines()
+}
+
+// emit passes an event to the main loop of the running gazer as if the file was updated.
+func emit(gazer *Gazer, events ...notify.Event) {
+	for _, e := range events {
+		gazer.notify.Events <- e
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	ignoreSigterm, ready := ignoringSigtermCommand()
+	commandConfig1 := &config.Command{Ext: []string{".py"}, Cmd: `python -c "import time; time.sleep(30)"`}
+	commandConfig2 := &config.Command{Ext: []string{".py"}, Cmd: ignoreSigterm, StopGraceMs: 300}
+	inv1 := prepareInvocation(commandConfig1, "a.py", 60*1000, false)
+	inv2 := prepareInvocation(commandConfig2, "a.py", 60*1000, false)
+	gazer.dispatch(inv1, notify.Event{Name: "a.py", Time: time.Now().UnixNano()}, nil)
+	gazer.dispatch(inv2, notify.Event{Name: "a.py", Time: time.Now().UnixNano()}, nil)
+
+	var proc1, proc2 *process
+	for i := 0; i < 200; i++ {
+		time.Sleep(20 * time.Millisecond)
+		proc1 = getProcess(&gazer.commands, inv1.queueManageKey)
+		proc2 = getProcess(&gazer.commands, inv2.queueManageKey)
+		if proc1 != nil && proc1.started() != nil && proc2 != nil && proc2.started() != nil {
+			break
+		}
+	}
+	waitForFile(t, ready)
 
-	command, err = getMatchedCommand("a.txt", commandConfigs.Commands)
-	if command != "" || err != nil {
+	err := gazer.shutdown(syscall.SIGTERM)
+	var shutdownErr *ShutdownError
+	if !errors.As(err, &shutdownErr) || shutdownErr.Unstopped != 0 || shutdownErr.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Fatal(err)
+	}
+	if !hasExited(proc1) || !hasExited(proc2) {
 		t.Fatal()
 	}
+	if len(gazer.commands.keys()) != 0 {
+		t.Fatal(gazer.commands.keys())
+	}
+}
 
-	command, err = getMatchedCommand("a.rb", commandConfigs.Commands)
-	if command != "" || err == nil {
+func TestShutdownTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+	gazer.shutdownTimeoutMills = 200
+	ignoreSigterm, ready := ignoringSigtermCommand()
+
+	// The grace period is longer than the shutdown timeout
+	commandConfig := &config.Command{Ext: []string{".py"}, Cmd: ignoreSigterm, StopGraceMs: 60 * 1000}
+	inv := prepareInvocation(commandConfig, "a.py", 60*1000, false)
+	gazer.dispatch(inv, notify.Event{Name: "a.py", Time: time.Now().UnixNano()}, nil)
+
+	var proc *process
+	waitFor(t, func() bool {
+		proc = getProcess(&gazer.commands, inv.queueManageKey)
+		return proc != nil && proc.started() != nil
+	})
+	waitForFile(t, ready)
+
+	err := gazer.shutdown(syscall.SIGINT)
+	var shutdownErr *ShutdownError
+	if !errors.As(err, &shutdownErr) || shutdownErr.Unstopped != 1 || shutdownErr.ExitCode() != 1 {
+		t.Fatal(err)
+	}
+	// Killed when the shutdown timeout runs out, not left running after Gaze exits
+	if !hasExited(proc) {
+		t.Fatal("still running after shutdown")
+	}
+}
+
+func TestShutdownSecondSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+	gazer.ShutdownTimeout(30 * 1000)
+	signals := make(chan os.Signal, 1)
+	gazer.shutdownSignal = signals
+	ignoreSigterm, ready := ignoringSigtermCommand()
+
+	commandConfig := &config.Command{Ext: []string{".py"}, Cmd: ignoreSigterm, StopGraceMs: 30 * 1000}
+	inv := prepareInvocation(commandConfig, "a.py", 60*1000, false)
+	gazer.dispatch(inv, notify.Event{Name: "a.py", Time: time.Now().UnixNano()}, nil)
+
+	var proc *process
+	waitFor(t, func() bool {
+		proc = getProcess(&gazer.commands, inv.queueManageKey)
+		return proc != nil && proc.started() != nil
+	})
+	waitForFile(t, ready)
+
+	start := time.Now()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		signals <- syscall.SIGINT
+	}()
+	err := gazer.shutdown(syscall.SIGINT)
+	var shutdownErr *ShutdownError
+	if !errors.As(err, &shutdownErr) || shutdownErr.Signal != syscall.SIGINT {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal(time.Since(start))
+	}
+	// Killed without waiting for the grace period
+	if !waitForExit(proc, 5000) {
+		t.Fatal()
+	}
+}
+
+func TestShutdownTimeoutDefault(t *testing.T) {
+	g := &Gazer{}
+	g.ShutdownTimeout(3000)
+	if g.shutdownTimeoutMills != 3000 {
+		t.Fatal(g.shutdownTimeoutMills)
+	}
+	g.ShutdownTimeout(0)
+	if g.shutdownTimeoutMills != defaultShutdownTimeoutMills {
+		t.Fatal(g.shutdownTimeoutMills)
+	}
+}
+
+func TestShutdownError(t *testing.T) {
+	err := &ShutdownError{Signal: syscall.SIGINT}
+	if err.ExitCode() != 130 || err.Error() != "interrupt" {
+		t.Fatal(err.ExitCode(), err.Error())
+	}
+	err = &ShutdownError{Signal: syscall.SIGHUP, Unstopped: 2}
+	if err.ExitCode() != 1 || err.Error() != "hangup: 2 command(s) did not exit in time" {
+		t.Fatal(err.ExitCode(), err.Error())
+	}
+}
+
+func TestFillLine(t *testing.T) {
+	if fillLine("12:00 ", 10) != "12:00 ────" {
+		t.Fatal(fillLine("12:00 ", 10))
+	}
+	if fillLine("", 3) != "───" {
 		t.Fatal()
 	}
-	command, err = getMatchedCommand("a.py", commandConfigs.Commands)
-	if command != "" || err == nil {
+	if fillLine("── long ──", 5) != "── long ──" {
 		t.Fatal()
 	}
 }
@@ -0,0 +1,186 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/logger"
+	"github.com/wtetsu/gaze/pkg/notify"
+)
+
+// keyInput reads keys from the terminal while Gaze is gazing.
+// It is suspended while a command that reads stdin is running.
+type keyInput struct {
+	keys      chan byte
+	done      chan struct{}
+	terminal  *terminal
+	suspended int
+	closed    bool
+	mutex     sync.Mutex
+}
+
+// startKeyInput starts reading keys. Returns nil if stdin is not a terminal.
+func startKeyInput() *keyInput {
+	t, err := openTerminal()
+	if err != nil {
+		logger.Info("Keys are disabled: %v", err)
+		return nil
+	}
+	err = t.keyMode()
+	if err != nil {
+		logger.Info("Keys are disabled: %v", err)
+		return nil
+	}
+
+	k := &keyInput{keys: make(chan byte), done: make(chan struct{}), terminal: t}
+	go k.run()
+	return k
+}
+
+func (k *keyInput) run() {
+	buf := make([]byte, 1)
+	for {
+		k.mutex.Lock()
+		if k.closed {
+			k.mutex.Unlock()
+			return
+		}
+		if k.suspended > 0 {
+			k.mutex.Unlock()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		// Reading while locked so that the terminal is never given to a command in the middle of a read
+		n, err := k.terminal.read(buf)
+		k.mutex.Unlock()
+		if err != nil {
+			logger.Debug("Key input stopped: %v", err)
+			return
+		}
+		if n == 1 {
+			select {
+			case k.keys <- buf[0]:
+			case <-k.done:
+				return
+			}
+		}
+	}
+}
+
+// channel returns the channel of keys. A nil channel is returned if keys are disabled so that it never receives.
+func (k *keyInput) channel() <-chan byte {
+	if k == nil {
+		return nil
+	}
+	return k.keys
+}
+
+// suspend gives the terminal back in the normal mode, e.g. to a command reading stdin.
+func (k *keyInput) suspend() {
+	if k == nil {
+		return
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.suspended++
+	if k.suspended == 1 && !k.closed {
+		k.terminal.restore()
+	}
+}
+
+// resume starts reading keys again.
+func (k *keyInput) resume() {
+	if k == nil {
+		return
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.suspended--
+	if k.suspended == 0 && !k.closed {
+		k.terminal.keyMode()
+	}
+}
+
+// close stops reading keys and restores the terminal.
+func (k *keyInput) close() {
+	if k == nil {
+		return
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.closed {
+		return
+	}
+	k.closed = true
+	close(k.done)
+	k.terminal.restore()
+}
+
+const keysHelp = "Keys: r: rerun, a: run all, c: clear, p: pause/resume, k: kill, q: quit"
+
+// handleKey runs the action of a key. Returns true with the result of Run if Gaze should quit.
+func (g *Gazer) handleKey(key byte, commandConfigs *config.Config, timeoutMills int64, restart bool) (bool, error) {
+	switch key {
+	case 'r':
+		g.rerun(commandConfigs, timeoutMills, restart)
+	case 'a':
+		g.runAll(commandConfigs, timeoutMills, restart)
+	case 'c':
+		clearScreen(g.screen, g.clear == config.ClearScrollback)
+	case 'p':
+		g.paused = !g.paused
+		if g.paused {
+			logger.Notice("Paused (press p to resume)")
+		} else {
+			logger.Notice("Resumed")
+		}
+	case 'k':
+		go g.stopAll("Kill", nil)
+	case 'q':
+		return true, g.quit()
+	case '?', 'h':
+		logger.Notice(keysHelp)
+	}
+	return false, nil
+}
+
+// rerun runs the commands of the last changed file again.
+func (g *Gazer) rerun(commandConfigs *config.Config, timeoutMills int64, restart bool) {
+	if g.lastFile == "" {
+		logger.Notice("Nothing to rerun")
+		return
+	}
+	g.handleEvent(commandConfigs, timeoutMills, restart, notify.Event{Name: g.lastFile, Time: time.Now().UnixNano()})
+}
+
+// runAll runs the commands of all the files that have changed since Gaze started.
+// Since all the events have the same time, each command runs only once.
+func (g *Gazer) runAll(commandConfigs *config.Config, timeoutMills int64, restart bool) {
+	files := g.history.List()
+	if len(files) == 0 {
+		logger.Notice("Nothing to run")
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, filePath := range files {
+		g.handleEvent(commandConfigs, timeoutMills, restart, notify.Event{Name: filePath, Time: now})
+	}
+}
+
+// quit stops all the running commands and returns nil if all of them have exited.
+func (g *Gazer) quit() error {
+	g.stopping.Store(true)
+	unstopped := g.stopAll("Quit", g.shutdownSignal)
+	if unstopped > 0 {
+		return fmt.Errorf("%d command(s) did not exit in time", unstopped)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/notify"
+)
+
+func TestHandleKey(t *testing.T) {
+	py1 := createTempFile("*.py", `#`)
+	py2 := createTempFile("*.py", `#`)
+	if py1 == "" || py2 == "" {
+		t.Fatal("Temp files error")
+	}
+	out := filepath.Join(filepath.Dir(py1), "out.log")
+
+	gazer, _ := New([]string{py1, py2}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	commandConfigs := &config.Config{Commands: []config.Command{{
+		Ext: []string{".py"},
+		Cmd: `python -c "import sys; open(sys.argv[1], 'a').write(sys.argv[2] + chr(10))" "` + out + `" "{{base}}"`,
+	}}}
+	lines := func(expected int) []string {
+		for i := 0; i < 200; i++ {
+			b, _ := os.ReadFile(out)
+			l := strings.Fields(string(b))
+			if len(l) >= expected && len(gazer.commands.keys()) == 0 {
+				return l
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("timeout")
+		return nil
+	}
+
+	// Nothing has changed yet
+	gazer.handleKey('r', commandConfigs, 10*1000, false)
+	gazer.handleKey('a', commandConfigs, 10*1000, false)
+	time.Sleep(100 * time.Millisecond)
+	if gazer.InvokeCount() != 0 {
+		t.Fatal(gazer.InvokeCount())
+	}
+
+	gazer.handleEvent(commandConfigs, 10*1000, false, notify.Event{Name: py1, Time: time.Now().UnixNano()})
+	lines(1)
+	gazer.handleEvent(commandConfigs, 10*1000, false, notify.Event{Name: py2, Time: time.Now().UnixNano()})
+	lines(2)
+
+	// r: the last file
+	gazer.handleKey('r', commandConfigs, 10*1000, false)
+	l := lines(3)
+	if l[2] != filepath.Base(py2) {
+		t.Fatal(l)
+	}
+
+	// a: all the files
+	gazer.handleKey('a', commandConfigs, 10*1000, false)
+	l = lines(5)
+	if len(l) != 5 || !strings.Contains(strings.Join(l[3:], " "), filepath.Base(py1)) {
+		t.Fatal(l)
+	}
+
+	// p: pause and resume
+	gazer.handleKey('p', commandConfigs, 10*1000, false)
+	if !gazer.paused {
+		t.Fatal()
+	}
+	gazer.handleKey('p', commandConfigs, 10*1000, false)
+	if gazer.paused {
+		t.Fatal()
+	}
+
+	quit, _ := gazer.handleKey('x', commandConfigs, 10*1000, false)
+	if quit {
+		t.Fatal()
+	}
+	quit, err := gazer.handleKey('q', commandConfigs, 10*1000, false)
+	if !quit || err != nil || !gazer.stopping.Load() {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleKeyKill(t *testing.T) {
+	py1 := createTempFile("*.py", `#`)
+	if py1 == "" {
+		t.Fatal("Temp files error")
+	}
+	gazer, _ := New([]string{py1}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	command := `python -c "import time; time.sleep(30)"`
+	commandConfigs := &config.Config{Commands: []config.Command{{Ext: []string{".py"}, Cmd: command}}}
+	gazer.handleEvent(commandConfigs, 60*1000, false, notify.Event{Name: py1, Time: time.Now().UnixNano()})
+	for i := 0; i < 200; i++ {
+		proc := getProcess(&gazer.commands, command)
+		if proc != nil && proc.started() != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	proc := getProcess(&gazer.commands, command)
+	if proc == nil || proc.started() == nil {
+		t.Fatal("not started")
+	}
+
+	gazer.handleKey('k', commandConfigs, 60*1000, false)
+	for i := 0; i < 300 && len(gazer.commands.keys()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if keys := gazer.commands.keys(); len(keys) != 0 || !hasExited(proc) {
+		t.Fatal(keys)
+	}
+}
+
+func TestKeyInputDisabled(t *testing.T) {
+	// Every method is safe when keys are disabled
+	var k *keyInput
+	k.suspend()
+	k.resume()
+	k.close()
+	if k.channel() != nil {
+		t.Fatal()
+	}
+}
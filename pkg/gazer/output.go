@@ -0,0 +1,184 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/logger"
+)
+
+// outputMutex keeps prefixed lines and grouped runs from being mixed with each other.
+var outputMutex sync.Mutex
+
+// runOutput writes the output of the commands of a run in an output mode.
+// A nil runOutput writes the output as it is.
+type runOutput struct {
+	mode    string
+	out     io.Writer     // Where grouped stdout is written
+	err     io.Writer     // Where grouped stderr is written
+	stdout  *prefixWriter // Used with config.OutputPrefix
+	stderr  *prefixWriter // Used with config.OutputPrefix
+	entries []outputEntry // Buffered output and logs with config.OutputGrouped
+	mutex   sync.Mutex
+}
+
+// outputEntry is a piece of grouped output. Either data or log is set.
+type outputEntry struct {
+	stderr bool
+	data   []byte
+	log    func()
+}
+
+// newRunOutput returns a runOutput writing to os.Stdout and os.Stderr. Returns nil for config.OutputRaw.
+// label is the prefix of each line with config.OutputPrefix. Labels with the same colorKey have the same color.
+func newRunOutput(mode string, label string, colorKey string) *runOutput {
+	return newRunOutputTo(mode, label, colorKey, os.Stdout, os.Stderr)
+}
+
+func newRunOutputTo(mode string, label string, colorKey string, out io.Writer, err io.Writer) *runOutput {
+	switch mode {
+	case config.OutputPrefix:
+		h := fnv.New32a()
+		h.Write([]byte(colorKey))
+		n := int(h.Sum32() & 0xffff)
+		return &runOutput{
+			mode:   mode,
+			stdout: &prefixWriter{file: out, prefix: logger.Label("["+label+"]", n) + " "},
+			stderr: &prefixWriter{file: err, prefix: logger.Label("["+label+":err]", n) + " "},
+		}
+	case config.OutputGrouped:
+		return &runOutput{mode: mode, out: out, err: err}
+	}
+	return nil
+}
+
+// stdoutWriter returns the writer for stdout of a command.
+func (o *runOutput) stdoutWriter() io.Writer {
+	if o == nil {
+		return os.Stdout
+	}
+	if o.mode == config.OutputPrefix {
+		return o.stdout
+	}
+	return &groupWriter{output: o}
+}
+
+// stderrWriter returns the writer for stderr of a command.
+func (o *runOutput) stderrWriter() io.Writer {
+	if o == nil {
+		return os.Stderr
+	}
+	if o.mode == config.OutputPrefix {
+		return o.stderr
+	}
+	return &groupWriter{output: o, stderr: true}
+}
+
+// log calls f to write a log. With config.OutputGrouped, f is called with the output when the run finishes.
+func (o *runOutput) log(f func()) {
+	if o == nil || o.mode != config.OutputGrouped {
+		f()
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.entries = append(o.entries, outputEntry{log: f})
+}
+
+// flush writes what is left: the last line without a newline, or the whole grouped output.
+func (o *runOutput) flush() {
+	if o == nil {
+		return
+	}
+	if o.mode == config.OutputPrefix {
+		o.stdout.flush()
+		o.stderr.flush()
+		return
+	}
+
+	o.mutex.Lock()
+	entries := o.entries
+	o.entries = nil
+	o.mutex.Unlock()
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	for _, e := range entries {
+		switch {
+		case e.log != nil:
+			e.log()
+		case e.stderr:
+			o.err.Write(e.data)
+		default:
+			o.out.Write(e.data)
+		}
+	}
+}
+
+// prefixWriter writes each line with a prefix.
+type prefixWriter struct {
+	file   io.Writer
+	prefix string
+	buf    []byte // The last line without a newline
+	mutex  sync.Mutex
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *prefixWriter) flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if len(w.buf) == 0 {
+		return
+	}
+	w.writeLine(append(w.buf, '\n'))
+	w.buf = nil
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	w.file.Write(append([]byte(w.prefix), line...))
+}
+
+// groupWriter buffers the output of a stream in order with the other stream.
+type groupWriter struct {
+	output *runOutput
+	stderr bool
+}
+
+func (w *groupWriter) Write(p []byte) (int, error) {
+	o := w.output
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	last := len(o.entries) - 1
+	if last >= 0 && o.entries[last].log == nil && o.entries[last].stderr == w.stderr {
+		o.entries[last].data = append(o.entries[last].data, p...)
+	} else {
+		o.entries = append(o.entries, outputEntry{stderr: w.stderr, data: bytes.Clone(p)})
+	}
+	return len(p), nil
+}
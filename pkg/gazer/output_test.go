@@ -0,0 +1,119 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/logger"
+)
+
+func TestRunOutputRaw(t *testing.T) {
+	output := newRunOutput(config.OutputRaw, "a.py", "")
+	if output != nil || output.stdoutWriter() != os.Stdout || output.stderrWriter() != os.Stderr {
+		t.Fatal()
+	}
+	called := false
+	output.log(func() { called = true })
+	if !called {
+		t.Fatal()
+	}
+	output.flush()
+}
+
+func TestRunOutputPrefix(t *testing.T) {
+	logger.Plain()
+	var out, err bytes.Buffer
+	output := newRunOutputTo(config.OutputPrefix, "a.py", "python a.py", &out, &err)
+
+	output.stdoutWriter().Write([]byte("1\n2"))
+	output.stderrWriter().Write([]byte("e\n"))
+	output.stdoutWriter().Write([]byte("3\n4"))
+	if out.String() != "[a.py] 1\n[a.py] 23\n" || err.String() != "[a.py:err] e\n" {
+		t.Fatalf("%q %q", out.String(), err.String())
+	}
+	output.flush()
+	if out.String() != "[a.py] 1\n[a.py] 23\n[a.py] 4\n" {
+		t.Fatalf("%q", out.String())
+	}
+}
+
+func TestRunOutputGrouped(t *testing.T) {
+	var out, err bytes.Buffer
+	output := newRunOutputTo(config.OutputGrouped, "a.py", "", &out, &err)
+
+	var logs []string
+	output.log(func() { logs = append(logs, "start:"+out.String()) })
+	output.stdoutWriter().Write([]byte("1\n"))
+	output.stderrWriter().Write([]byte("e\n"))
+	output.stdoutWriter().Write([]byte("2\n"))
+	output.stdoutWriter().Write([]byte("3\n"))
+	output.log(func() { logs = append(logs, "end:"+out.String()) })
+	if out.Len() != 0 || err.Len() != 0 || len(logs) != 0 {
+		t.Fatal()
+	}
+
+	output.flush()
+	if out.String() != "1\n2\n3\n" || err.String() != "e\n" {
+		t.Fatalf("%q %q", out.String(), err.String())
+	}
+	if len(logs) != 2 || logs[0] != "start:" || logs[1] != "end:1\n2\n3\n" {
+		t.Fatal(logs)
+	}
+	if len(output.entries) != 0 {
+		t.Fatal()
+	}
+}
+
+func TestRunOutputCommand(t *testing.T) {
+	var out, err bytes.Buffer
+	output := newRunOutputTo(config.OutputPrefix, "a.py", "", &out, &err)
+	proc := newProcess(createCommand(`python -c "import sys; print(1); sys.stderr.write('e'+chr(10)); sys.stdout.write('2')"`, commandOptions{output: output}))
+	cmdResult := executeCommandOrTimeout(proc, 10*1000, stopOptions{})
+	output.flush()
+	if cmdResult.Err != nil {
+		t.Fatal(cmdResult.Err)
+	}
+	if out.String() != "[a.py] 1\n[a.py] 2\n" || err.String() != "[a.py:err] e\n" {
+		t.Fatalf("%q %q", out.String(), err.String())
+	}
+}
+
+func TestOutputLabel(t *testing.T) {
+	if outputLabel(&config.Command{}, []string{"python src/a.py"}, "src/a.py") != "a.py" {
+		t.Fatal()
+	}
+	if outputLabel(&config.Command{Batch: 100}, []string{"/usr/bin/eslint a.js b.js"}, "a.js") != "eslint" {
+		t.Fatal()
+	}
+	if outputLabel(nil, nil, "") != "gaze" {
+		t.Fatal()
+	}
+}
+
+func TestOutputMode(t *testing.T) {
+	g := &Gazer{}
+	inv := &invocation{}
+	if g.outputMode(inv) != "" {
+		t.Fatal()
+	}
+	g.Output(config.OutputGrouped)
+	if g.outputMode(inv) != config.OutputGrouped {
+		t.Fatal()
+	}
+	inv.output = config.OutputPrefix
+	if g.outputMode(inv) != config.OutputPrefix {
+		t.Fatal()
+	}
+	inv.options.stdin = true
+	if g.outputMode(inv) != config.OutputRaw {
+		t.Fatal()
+	}
+}
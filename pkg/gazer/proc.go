@@ -9,14 +9,18 @@ package gazer
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/mattn/go-shellwords"
+	"github.com/wtetsu/gaze/pkg/config"
 	"github.com/wtetsu/gaze/pkg/gutil"
 	"github.com/wtetsu/gaze/pkg/logger"
 )
@@ -25,10 +29,75 @@ type CmdResult struct {
 	StartTime time.Time
 	EndTime   time.Time
 	Err       error
+	ExitCode  int // -1 if the process did not exit normally
 }
 
-func executeCommandOrTimeout(cmd *exec.Cmd, timeoutMills int64) CmdResult {
-	exec := executeCommandAsync(cmd)
+// process is a command that other goroutines can stop without touching exec.Cmd.
+// The goroutine running the command publishes the process after Start, and closes done after Wait.
+type process struct {
+	cmd   *exec.Cmd
+	mutex sync.Mutex
+	proc  *os.Process   // nil until the command starts
+	ready chan struct{} // Closed after the command has started, failed to start or been discarded
+	done  chan struct{} // Closed after the command has exited and been waited
+}
+
+func newProcess(cmd *exec.Cmd) *process {
+	p := &process{cmd: cmd, ready: make(chan struct{}), done: make(chan struct{})}
+	if cmd == nil {
+		// It never starts
+		close(p.ready)
+	}
+	return p
+}
+
+// start starts the command. Call it from the goroutine running the command.
+func (p *process) start() error {
+	defer close(p.ready)
+	err := p.cmd.Start()
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.proc = p.cmd.Process
+	return nil
+}
+
+// discard marks the command as never starting. Call it instead of start.
+func (p *process) discard() {
+	if p.cmd != nil {
+		close(p.ready)
+	}
+}
+
+// wait waits for the command to exit. Call it from the goroutine running the command.
+func (p *process) wait() error {
+	defer close(p.done)
+	return p.cmd.Wait()
+}
+
+// started returns the process of the command. nil if it has not started yet.
+func (p *process) started() *os.Process {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.proc
+}
+
+// waitForStart waits until the command starts and returns its process.
+// nil if the command does not start within timeoutMills or will never start.
+func (p *process) waitForStart(timeoutMills int64) *os.Process {
+	timer := time.NewTimer(time.Duration(timeoutMills) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-p.ready:
+	case <-timer.C:
+	}
+	return p.started()
+}
+
+func executeCommandOrTimeout(proc *process, timeoutMills int64, stop stopOptions) CmdResult {
+	exec := executeCommandAsync(proc)
 
 	var cmdResult CmdResult
 	var launchedTime = time.Now()
@@ -40,13 +109,13 @@ func executeCommandOrTimeout(cmd *exec.Cmd, timeoutMills int64) CmdResult {
 		}
 		select {
 		case <-timeout:
-			if cmd.Process == nil {
+			if proc.started() == nil {
 				timeout = gutil.After(5)
 				continue
 			}
-			kill(cmd, "Timeout")
+			terminate(proc, stop, "Timeout")
 			finished = true
-			cmdResult = CmdResult{StartTime: launchedTime, EndTime: time.Now(), Err: errors.New("")}
+			cmdResult = CmdResult{StartTime: launchedTime, EndTime: time.Now(), Err: errors.New(""), ExitCode: -1}
 		case cmdResult = <-exec:
 			finished = true
 		}
@@ -55,39 +124,47 @@ func executeCommandOrTimeout(cmd *exec.Cmd, timeoutMills int64) CmdResult {
 		return cmdResult
 	}
 
-	if cmd.ProcessState != nil {
-		exitCode := cmd.ProcessState.ExitCode()
-		if exitCode != 0 {
-			cmdResult.Err = fmt.Errorf("exitCode:%d", exitCode)
-			return cmdResult
-		}
+	if cmdResult.ExitCode != 0 {
+		cmdResult.Err = fmt.Errorf("exitCode:%d", cmdResult.ExitCode)
+		return cmdResult
 	}
 
 	return cmdResult
 }
 
-func executeCommandAsync(cmd *exec.Cmd) <-chan CmdResult {
-	ch := make(chan CmdResult)
+func executeCommandAsync(proc *process) <-chan CmdResult {
+	ch := make(chan CmdResult, 1) // Buffered so that the sender never blocks after a timeout
 
 	go func() {
-		if cmd == nil {
-			ch <- CmdResult{Err: errors.New("failed: cmd is nil")}
+		if proc.cmd == nil {
+			ch <- CmdResult{Err: errors.New("failed: cmd is nil"), ExitCode: -1}
 			return
 		}
-		cmdResult := executeCommand(cmd)
+		cmdResult := executeCommand(proc)
 		ch <- cmdResult
 	}()
 	return ch
 }
 
-func executeCommand(cmd *exec.Cmd) CmdResult {
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func executeCommand(proc *process) CmdResult {
+	cmd := proc.cmd
+	stdout, ok := cmd.Stdout.(*ptyWriter)
+	if ok {
+		stderr, _ := cmd.Stderr.(*ptyWriter)
+		return executeCommandWithPty(proc, stdout, stderr)
+	}
+
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
 
 	start := time.Now()
-	err := cmd.Start()
+	err := proc.start()
 	if err != nil {
-		return CmdResult{StartTime: start, EndTime: time.Now(), Err: err}
+		return CmdResult{StartTime: start, EndTime: time.Now(), Err: err, ExitCode: -1}
 	}
 
 	if cmd.Process != nil {
@@ -95,55 +172,327 @@ func executeCommand(cmd *exec.Cmd) CmdResult {
 	} else {
 		logger.Info("Pid: ????")
 	}
-	err = cmd.Wait()
+	err = proc.wait()
+
+	return CmdResult{StartTime: start, EndTime: time.Now(), Err: err, ExitCode: exitCode(cmd)}
+}
+
+// exitCode returns the exit code of a waited command. -1 if the process did not exit normally.
+func exitCode(cmd *exec.Cmd) int {
+	if cmd.ProcessState == nil {
+		return -1
+	}
+	return cmd.ProcessState.ExitCode()
+}
 
-	return CmdResult{StartTime: start, EndTime: time.Now(), Err: err}
+// ptyWriter marks the output of a command to run under pseudo-terminals. See commandOptions.pty.
+type ptyWriter struct {
+	io.Writer
 }
 
-func kill(cmd *exec.Cmd, reason string) bool {
-	if cmd == nil || cmd.Process == nil {
+// executeCommandWithPty runs a command whose stdout and stderr are pseudo-terminals so that the command writes colors.
+// Stdout and stderr have their own pseudo-terminals to keep them apart. The output is relayed to the writers.
+// The command runs without a pseudo-terminal if it cannot be opened.
+func executeCommandWithPty(proc *process, stdout *ptyWriter, stderr *ptyWriter) CmdResult {
+	cmd := proc.cmd
+	cmd.Stdout = stdout.Writer
+	cmd.Stderr = stderr.Writer
+
+	outPty, err := openPty()
+	if err != nil {
+		logger.Info("pty: %v", err)
+		return executeCommand(proc)
+	}
+	defer outPty.master.Close()
+	errPty, err := openPty()
+	if err != nil {
+		outPty.slave.Close()
+		logger.Info("pty: %v", err)
+		return executeCommand(proc)
+	}
+	defer errPty.master.Close()
+
+	cmd.Stdout = outPty.slave
+	cmd.Stderr = errPty.slave
+	setControllingTerminal(cmd)
+	stopRelay := relayWindowSize(outPty, errPty)
+	defer stopRelay()
+
+	start := time.Now()
+	err = proc.start()
+	// The command has its own copies. Reads from master end when the command and its children close them
+	outPty.slave.Close()
+	errPty.slave.Close()
+	if err != nil {
+		return CmdResult{StartTime: start, EndTime: time.Now(), Err: err, ExitCode: -1}
+	}
+	logger.Info("Pid: %d (pty)", cmd.Process.Pid)
+
+	outDone := relayPty(outPty.master, stdout.Writer)
+	errDone := relayPty(errPty.master, stderr.Writer)
+	err = proc.wait()
+	end := time.Now()
+
+	cmdResult := CmdResult{StartTime: start, EndTime: end, Err: err, ExitCode: exitCode(cmd)}
+
+	// Children that are still alive may keep writing. Do not wait for them forever
+	timer := time.NewTimer(outputWaitDelay)
+	defer timer.Stop()
+	for _, done := range []<-chan struct{}{outDone, errDone} {
+		select {
+		case <-done:
+		case <-timer.C:
+			return cmdResult
+		}
+	}
+	return cmdResult
+}
+
+// relayPty copies the output from a pty until it is closed. Reading the master returns EIO after all the slaves are closed.
+func relayPty(master *os.File, w io.Writer) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(w, master)
+	}()
+	return done
+}
+
+// stopOptions decides how a running process is stopped.
+type stopOptions struct {
+	signal     os.Signal // Sent first. SIGTERM if nil
+	graceMills int64     // SIGKILL is sent if the process does not exit within this period
+}
+
+const defaultStopGraceMills = 5000
+
+// killWaitMills is how long killAll waits for killed processes. SIGKILL cannot be ignored, so it is short.
+const killWaitMills = 1000
+
+// Signals available as a stop signal
+var stopSignals = map[string]os.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+func newStopOptions(signalName string, graceMills int64) stopOptions {
+	return stopOptions{signal: stopSignals[signalName], graceMills: graceMills}
+}
+
+// terminate stops a process and returns after it has exited.
+// A process about to start is waited for up to the grace period.
+// It sends the stop signal first, and SIGKILL if the process is still alive after the grace period.
+func terminate(proc *process, options stopOptions, reason string) bool {
+	if proc == nil {
 		return false
 	}
-	if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
+	graceMills := options.graceMills
+	if graceMills <= 0 {
+		graceMills = defaultStopGraceMills
+	}
+	p := proc.waitForStart(graceMills)
+	if p == nil || hasExited(proc) {
 		return false
 	}
 
-	var signal os.Signal
+	signal := options.signal
+	if signal == nil {
+		signal = syscall.SIGTERM
+	}
 	if runtime.GOOS == "windows" {
 		signal = os.Kill
-	} else {
-		signal = syscall.SIGTERM
 	}
-	err := cmd.Process.Signal(signal)
+
+	pid := p.Pid
+	logger.Notice("%s: sending %v to %d", reason, signal, pid)
+	err := signalProcess(p, signal)
 	if err != nil {
+		if !errors.Is(err, os.ErrProcessDone) {
+			logger.Notice("kill failed: %v", err)
+		}
+		return false
+	}
+	if waitForExit(proc, graceMills) {
+		logger.Notice("%s: %d has exited", reason, pid)
+		return true
+	}
+
+	logger.Notice("%s: %d did not exit within %dms, sending %v", reason, pid, graceMills, os.Kill)
+	err = signalProcess(p, os.Kill)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
 		logger.Notice("kill failed: %v", err)
 		return false
 	}
-	logger.Notice("%s: %d has been killed", reason, cmd.Process.Pid)
+	waitForExit(proc, defaultStopGraceMills)
+	logger.Notice("%s: %d has been killed", reason, pid)
 	return true
 }
 
-func createCommand(commandString string) *exec.Cmd {
+// killNow sends SIGKILL to a process without waiting for it to exit.
+func killNow(proc *process) {
+	p := proc.started()
+	if p == nil || hasExited(proc) {
+		return
+	}
+	err := signalProcess(p, os.Kill)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		logger.Notice("kill failed: %v", err)
+	}
+}
+
+// killAll sends SIGKILL to the processes and waits a moment for them to exit.
+func killAll(procs []*process) {
+	for _, proc := range procs {
+		killNow(proc)
+	}
+	for _, proc := range procs {
+		if proc.started() != nil {
+			waitForExit(proc, killWaitMills)
+		}
+	}
+}
+
+// hasExited returns true if the process has exited and been waited.
+func hasExited(proc *process) bool {
+	select {
+	case <-proc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForExit waits until the process exits. Returns false if it is still alive after timeoutMills.
+func waitForExit(proc *process, timeoutMills int64) bool {
+	timer := time.NewTimer(time.Duration(timeoutMills) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-proc.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// commandOptions represents how a process is launched.
+type commandOptions struct {
+	dir    string   // Working directory. Empty means the current directory
+	env    []string // Additional environment variables ("KEY=value")
+	envLog []string // env for logs. Values from env_file are hidden
+	shell  string   // Shell to run the command with "<shell> -c". Empty means direct execution
+	// Interpreter to run the command as a script file. Empty means the command is not a script
+	interpreter string
+	stdin       bool       // Connect stdin of Gaze. The command stays in the process group of Gaze to read the terminal
+	output      *runOutput // Where the output is written. nil means os.Stdout and os.Stderr
+	pty         bool       // Run the command under pseudo-terminals (Linux only)
+	runLog      *runLog    // The output is also written to it if set
+}
+
+func createCommand(commandString string, options commandOptions) *exec.Cmd {
+	args, err := commandArgs(commandString, options.shell)
+	if err != nil || len(args) == 0 {
+		return nil
+	}
+	return newCommand(args, options)
+}
+
+// createScriptCommand creates a command that runs a script file with the interpreter.
+func createScriptCommand(scriptPath string, options commandOptions) *exec.Cmd {
+	args, err := shellwords.Parse(options.interpreter)
+	if err != nil || len(args) == 0 {
+		return nil
+	}
+	return newCommand(append(args, scriptPath), options)
+}
+
+// writeScript writes a script to a temporary file and returns its path.
+func writeScript(script string) (string, error) {
+	f, err := os.CreateTemp("", "gaze-script-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = f.WriteString(script + "\n")
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func newCommand(args []string, options commandOptions) *exec.Cmd {
+	var cmd *exec.Cmd
+	if len(args) == 1 {
+		cmd = exec.Command(args[0])
+	} else {
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+	if options.stdin {
+		cmd.Stdin = os.Stdin
+	} else {
+		setProcessGroup(cmd)
+	}
+	stdout := options.output.stdoutWriter()
+	stderr := options.output.stderrWriter()
+	if options.runLog != nil {
+		stdout = io.MultiWriter(stdout, options.runLog)
+		stderr = io.MultiWriter(stderr, options.runLog)
+	}
+	switch {
+	case options.pty:
+		cmd.Stdout = &ptyWriter{stdout}
+		cmd.Stderr = &ptyWriter{stderr}
+	case options.output != nil || options.runLog != nil:
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		// Do not wait forever for a child process that keeps the output open after the command exits
+		cmd.WaitDelay = outputWaitDelay
+	}
+	cmd.Dir = options.dir
+	if len(options.env) > 0 {
+		cmd.Env = append(os.Environ(), options.env...)
+	}
+	if len(options.envLog) > 0 {
+		logger.Info("Env: %s", strings.Join(options.envLog, " "))
+	}
+	return cmd
+}
+
+const outputWaitDelay = 3 * time.Second
+
+// commandArgs splits a command into the program and its arguments.
+// With a shell, the whole command is passed to "<shell> -c".
+func commandArgs(commandString string, shell string) ([]string, error) {
 	parser := shellwords.NewParser()
 	// parser.ParseBacktick = true
 	// parser.ParseEnv = true
-	args, err := parser.Parse(commandString)
-	if err != nil {
-		return nil
+	if shell == "" {
+		return parser.Parse(commandString)
 	}
-	if len(args) == 1 {
-		return exec.Command(args[0])
+	args, err := parser.Parse(resolveShell(shell))
+	if err != nil || len(args) == 0 {
+		return nil, err
 	}
-	return exec.Command(args[0], args[1:]...)
+	return append(args, "-c", commandString), nil
 }
 
-func sigIntChannel() chan struct{} {
-	ch := make(chan struct{})
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		<-c
-		close(ch)
-	}()
+// resolveShell returns $SHELL for config.ShellDefault, or sh if $SHELL is not set.
+func resolveShell(shell string) string {
+	if shell != config.ShellDefault {
+		return shell
+	}
+	if s := os.Getenv("SHELL"); s != "" {
+		return s
+	}
+	return "sh"
+}
+
+// shutdownSignalChannel receives the signals that stop Gaze.
+func shutdownSignalChannel() chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	return ch
 }
@@ -0,0 +1,120 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/notify"
+)
+
+// isRunning returns true if the process exists and is not a zombie.
+func isRunning(pid int) bool {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(b[strings.LastIndex(string(b), ")")+1:]))
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
+
+func TestRestartKillsProcessGroup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "_gaze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid.txt")
+
+	gazer, _ := New([]string{}, 100)
+	if gazer == nil {
+		t.Fatal()
+	}
+	defer gazer.Close()
+
+	// A shell with a background child
+	restart := true
+	commandConfig := &config.Command{
+		Ext:     []string{".sh"},
+		Cmd:     `sh -c "sleep 60 & echo $! > '` + pidFile + `'; wait"`,
+		Restart: &restart,
+	}
+	inv := prepareInvocation(commandConfig, "a.sh", 60*1000, false)
+	gazer.dispatch(inv, notify.Event{Name: "a.sh", Time: time.Now().UnixNano()}, nil)
+
+	shellPid, childPid := 0, 0
+	for i := 0; i < 200; i++ {
+		time.Sleep(20 * time.Millisecond)
+		b, _ := os.ReadFile(pidFile)
+		proc := getProcess(&gazer.commands, inv.queueManageKey)
+		if strings.HasSuffix(string(b), "\n") && proc != nil && proc.started() != nil {
+			childPid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+			shellPid = proc.started().Pid
+			break
+		}
+	}
+	if shellPid == 0 || childPid == 0 || !isRunning(shellPid) || !isRunning(childPid) {
+		t.Fatal("not started", shellPid, childPid)
+	}
+	os.Remove(pidFile)
+
+	gazer.dispatch(inv, notify.Event{Name: "a.sh", Time: time.Now().UnixNano()}, nil)
+
+	for i := 0; i < 100; i++ {
+		if !isRunning(shellPid) && !isRunning(childPid) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if isRunning(shellPid) || isRunning(childPid) {
+		t.Fatalf("still running: shell %v, child %v", isRunning(shellPid), isRunning(childPid))
+	}
+
+	// Clean up the restarted one
+	for i := 0; i < 200; i++ {
+		time.Sleep(20 * time.Millisecond)
+		proc := getProcess(&gazer.commands, inv.queueManageKey)
+		if proc != nil && proc.started() != nil && proc.started().Pid != shellPid {
+			terminate(proc, stopOptions{}, "test")
+			return
+		}
+	}
+}
+
+func TestPty(t *testing.T) {
+	var out, errOut bytes.Buffer
+	output := newRunOutputTo(config.OutputGrouped, "a.py", "", &out, &errOut)
+	script := "import os, sys; print(sys.stdout.isatty(), sys.stderr.isatty(), os.get_terminal_size().columns); sys.stderr.write('e'+chr(10)); sys.exit(3)"
+	proc := newProcess(createCommand(`python -c "`+script+`"`, commandOptions{pty: true, output: output}))
+	cmdResult := executeCommandOrTimeout(proc, 10*1000, stopOptions{})
+	output.flush()
+	if cmdResult.ExitCode != 3 || cmdResult.Err == nil {
+		t.Fatal(cmdResult)
+	}
+	if out.String() != "True True 80\n" || errOut.String() != "e\n" {
+		t.Fatalf("%q %q", out.String(), errOut.String())
+	}
+}
+
+func TestPtyBackgroundChild(t *testing.T) {
+	// A child that keeps the pty open does not block the command
+	start := time.Now()
+	proc := newProcess(createCommand(`sh -c "trap '' HUP; sleep 30 & echo started"`, commandOptions{pty: true}))
+	cmdResult := executeCommandOrTimeout(proc, 10*1000, stopOptions{})
+	if cmdResult.Err != nil || time.Since(start) > 10*time.Second {
+		t.Fatal(cmdResult, time.Since(start))
+	}
+	signalProcess(proc.started(), syscall.SIGKILL)
+}
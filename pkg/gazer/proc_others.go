@@ -0,0 +1,22 @@
+//go:build !linux
+
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// signalProcess sends a signal to the process.
+func signalProcess(p *os.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
@@ -8,67 +8,249 @@ package gazer
 
 import (
 	"math"
+	"os"
 	"os/exec"
+	"reflect"
+	"runtime"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/gutil"
 )
 
 func TestProc1(t *testing.T) {
 	// Very normal
-	cmd := createCommand("echo hello")
-	executeCommandOrTimeout(cmd, math.MaxInt64)
+	proc := newProcess(createCommand("echo hello", commandOptions{}))
+	executeCommandOrTimeout(proc, math.MaxInt64, stopOptions{})
 }
 
 func TestProc2(t *testing.T) {
 	// Kill using timeout
-	cmd := createCommand("sleep 60")
-	executeCommandOrTimeout(cmd, 100)
+	proc := newProcess(createCommand("sleep 60", commandOptions{}))
+	executeCommandOrTimeout(proc, 100, stopOptions{})
 }
 
 func TestProc3(t *testing.T) {
 	// Kill using a signal
-	cmd := createCommand("sleep 60")
-	go executeCommandOrTimeout(cmd, 60*10000)
+	proc := newProcess(createCommand("sleep 60", commandOptions{}))
+	go executeCommandOrTimeout(proc, 60*10000, stopOptions{})
 
 	for {
 		time.Sleep(50 * time.Millisecond)
-		if cmd.Process != nil {
-			cmd.Process.Kill()
+		if p := proc.started(); p != nil {
+			p.Kill()
 			break
 		}
 	}
 }
 
 func TestProc4(t *testing.T) {
-	cmd1 := createCommand("ls")
+	cmd1 := createCommand("ls", commandOptions{})
 	if len(cmd1.Args) != 1 {
 		t.Fatal()
 	}
-	if kill(cmd1, "test") {
+	// Never started
+	proc1 := newProcess(cmd1)
+	proc1.discard()
+	if terminate(proc1, stopOptions{}, "test") {
 		t.Fatal()
 	}
 
-	cmd2 := createCommand("ls aaa.txt")
+	cmd2 := createCommand("ls aaa.txt", commandOptions{})
 	if len(cmd2.Args) != 2 {
 		t.Fatal()
 	}
-	if kill(cmd2, "test") {
+	proc2 := newProcess(cmd2)
+	proc2.discard()
+	if terminate(proc2, stopOptions{}, "test") {
 		t.Fatal()
 	}
 
-	cmd3 := createCommand(`ls aaa.txt "Program Files"`)
+	cmd3 := createCommand(`ls aaa.txt "Program Files"`, commandOptions{})
 	if len(cmd3.Args) != 3 {
 		t.Fatal()
 	}
-	if kill(cmd3, "test") {
+	proc3 := newProcess(cmd3)
+	proc3.discard()
+	if terminate(proc3, stopOptions{}, "test") {
 		t.Fatal()
 	}
 }
 
 func TestProc5(t *testing.T) {
 	var cmd *exec.Cmd = nil
-	cmdResult := executeCommandOrTimeout(cmd, 100)
+	cmdResult := executeCommandOrTimeout(newProcess(cmd), 100, stopOptions{})
 	if cmdResult.Err == nil {
 		t.Fatal()
 	}
 }
+
+func TestCreateCommandWithOptions(t *testing.T) {
+	cmd := createCommand("ls", commandOptions{})
+	if cmd.Dir != "" || cmd.Env != nil {
+		t.Fatal()
+	}
+
+	cmd = createCommand("ls", commandOptions{dir: "/tmp", env: []string{"GAZE_TEST=1"}})
+	if cmd.Dir != "/tmp" {
+		t.Fatal(cmd.Dir)
+	}
+	if cmd.Env[len(cmd.Env)-1] != "GAZE_TEST=1" || len(cmd.Env) <= 1 {
+		t.Fatal(cmd.Env)
+	}
+
+	if createCommand("", commandOptions{}) != nil {
+		t.Fatal()
+	}
+}
+
+func TestCreateCommandWithStdin(t *testing.T) {
+	cmd := createCommand("ls", commandOptions{})
+	if cmd.Stdin != nil {
+		t.Fatal()
+	}
+	cmd = createCommand("ls", commandOptions{stdin: true})
+	if cmd.Stdin != os.Stdin || cmd.SysProcAttr != nil {
+		t.Fatal(cmd.SysProcAttr)
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	args, _ := commandArgs(`echo "a b" c`, "")
+	if !reflect.DeepEqual(args, []string{"echo", "a b", "c"}) {
+		t.Fatal(args)
+	}
+	args, _ = commandArgs(`echo "a b" | wc -c`, "bash -e")
+	if !reflect.DeepEqual(args, []string{"bash", "-e", "-c", `echo "a b" | wc -c`}) {
+		t.Fatal(args)
+	}
+
+	t.Setenv("SHELL", "/bin/zsh")
+	args, _ = commandArgs("ls", config.ShellDefault)
+	if !reflect.DeepEqual(args, []string{"/bin/zsh", "-c", "ls"}) {
+		t.Fatal(args)
+	}
+	t.Setenv("SHELL", "")
+	args, _ = commandArgs("ls", config.ShellDefault)
+	if !reflect.DeepEqual(args, []string{"sh", "-c", "ls"}) {
+		t.Fatal(args)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	cmdResult := executeCommandOrTimeout(newProcess(createCommand(`python -c "import sys; sys.exit(3)"`, commandOptions{})), 10*1000, stopOptions{})
+	if cmdResult.Err == nil || cmdResult.ExitCode != 3 {
+		t.Fatal(cmdResult)
+	}
+	cmdResult = executeCommandOrTimeout(newProcess(createCommand(`python -c "0"`, commandOptions{})), 10*1000, stopOptions{})
+	if cmdResult.Err != nil || cmdResult.ExitCode != 0 {
+		t.Fatal(cmdResult)
+	}
+	cmdResult = executeCommandOrTimeout(newProcess(nil), 10*1000, stopOptions{})
+	if cmdResult.Err == nil || cmdResult.ExitCode != -1 {
+		t.Fatal(cmdResult)
+	}
+}
+
+func TestNewStopOptions(t *testing.T) {
+	if newStopOptions("SIGINT", 100) != (stopOptions{signal: syscall.SIGINT, graceMills: 100}) {
+		t.Fatal()
+	}
+	if newStopOptions("", 0).signal != nil {
+		t.Fatal()
+	}
+}
+
+// startIgnoringSigterm starts a process that ignores SIGTERM and waits until it is ready.
+func startIgnoringSigterm(t *testing.T) *process {
+	ready := createTempFile("*.txt", "")
+	os.Remove(ready)
+	proc := newProcess(createCommand(`python -c "import signal, sys, time; signal.signal(signal.SIGTERM, signal.SIG_IGN); open(sys.argv[1], 'w').close(); time.sleep(30)" "`+ready+`"`, commandOptions{}))
+	go executeCommandOrTimeout(proc, 60*1000, stopOptions{})
+
+	for i := 0; i < 200; i++ {
+		if gutil.IsFile(ready) {
+			return proc
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("not started")
+	return nil
+}
+
+func TestTerminateEscalation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	proc := startIgnoringSigterm(t)
+
+	start := time.Now()
+	if !terminate(proc, stopOptions{graceMills: 300}, "test") {
+		t.Fatal()
+	}
+	elapsed := time.Since(start)
+	if elapsed < 300*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatal(elapsed)
+	}
+	if !hasExited(proc) {
+		t.Fatal()
+	}
+	if terminate(proc, stopOptions{}, "test") {
+		t.Fatal()
+	}
+}
+
+func TestTerminateBeforeStart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	proc := newProcess(createCommand("sleep 60", commandOptions{}))
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		executeCommandOrTimeout(proc, 60*1000, stopOptions{})
+	}()
+
+	// Waits for the process to start and stops it
+	if !terminate(proc, stopOptions{}, "test") {
+		t.Fatal()
+	}
+	if !hasExited(proc) {
+		t.Fatal()
+	}
+}
+
+func TestTerminateStopSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	proc := startIgnoringSigterm(t)
+
+	// SIGINT is not ignored
+	start := time.Now()
+	if !terminate(proc, newStopOptions("SIGINT", 10*1000), "test") {
+		t.Fatal()
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal(elapsed)
+	}
+	if !hasExited(proc) {
+		t.Fatal()
+	}
+}
+
+func TestTimeoutEscalation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	proc := newProcess(createCommand(`python -c "import signal, time; signal.signal(signal.SIGTERM, signal.SIG_IGN); time.sleep(30)"`, commandOptions{}))
+	start := time.Now()
+	cmdResult := executeCommandOrTimeout(proc, 500, stopOptions{graceMills: 300})
+	if cmdResult.Err == nil || !hasExited(proc) {
+		t.Fatal(cmdResult)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal(elapsed)
+	}
+}
@@ -0,0 +1,128 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// pty is a pseudo-terminal. A command writes to slave and Gaze reads it from master.
+type pty struct {
+	master *os.File
+	slave  *os.File
+}
+
+func openPty() (*pty, error) {
+	// Non-blocking so that Close stops a read even if a child still has the slave
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	var n int
+	err = control(master, func(fd int) error {
+		err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+		if err != nil {
+			return err
+		}
+		n, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	slave, err := os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	// Write "\n" as it is so that the output does not contain "\r" when it is prefixed or buffered
+	err = control(slave, func(fd int) error {
+		termios, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+		if err != nil {
+			return err
+		}
+		termios.Oflag &^= unix.ONLCR
+		return unix.IoctlSetTermios(fd, ioctlSetTermios, termios)
+	})
+	if err != nil {
+		master.Close()
+		slave.Close()
+		return nil, err
+	}
+	return &pty{master: master, slave: slave}, nil
+}
+
+// control calls f with the file descriptor. Unlike Fd(), it keeps the file non-blocking so that Close stops a read.
+func control(f *os.File, fn func(fd int) error) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	err = conn.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// setWinsize sets the window size of the pty.
+func (p *pty) setWinsize(ws *unix.Winsize) {
+	control(p.master, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, ws)
+	})
+}
+
+// setControllingTerminal runs the command in a new session whose controlling terminal is its stdout.
+// The command is the leader of its process group as with setProcessGroup.
+func setControllingTerminal(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 1}
+}
+
+// relayWindowSize sets the window size of the terminal of Gaze to ptys, and again whenever it changes.
+// Call the returned function to stop.
+func relayWindowSize(ptys ...*pty) func() {
+	resize := func() {
+		ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+		if err != nil || ws.Col == 0 {
+			ws = &unix.Winsize{Row: 24, Col: defaultTerminalWidth}
+		}
+		for _, p := range ptys {
+			p.setWinsize(ws)
+		}
+	}
+	resize()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, unix.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				resize()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
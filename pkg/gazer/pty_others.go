@@ -0,0 +1,31 @@
+//go:build !linux
+
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+type pty struct {
+	master *os.File
+	slave  *os.File
+}
+
+func openPty() (*pty, error) {
+	return nil, errors.New("pty is supported only on Linux")
+}
+
+func setControllingTerminal(cmd *exec.Cmd) {
+}
+
+func relayWindowSize(ptys ...*pty) func() {
+	return func() {}
+}
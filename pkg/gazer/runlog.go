@@ -0,0 +1,183 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wtetsu/gaze/pkg/config"
+	"github.com/wtetsu/gaze/pkg/logger"
+)
+
+// latestLink is the name of the symlink to the newest output file of a command.
+const latestLink = "latest"
+
+// runLogOptions decides where the output of a run is kept.
+type runLogOptions struct {
+	dir          string // Directory of the command: output_dir/key. Empty means the output is not kept
+	key          string
+	fileTemplate string
+	keep         int // Maximum number of files. 0 means unlimited
+	keepDays     int // Files older than this(days) are removed. 0 means unlimited
+	filePath     string
+	params       map[string]interface{}
+}
+
+func newRunLogOptions(commandConfig *config.Command, filePath string, params map[string]interface{}) runLogOptions {
+	if commandConfig.OutputDir == "" {
+		return runLogOptions{}
+	}
+	key := commandConfig.Key()
+	return runLogOptions{
+		dir:          filepath.Join(commandConfig.OutputDir, key),
+		key:          key,
+		fileTemplate: commandConfig.OutputFile,
+		keep:         commandConfig.OutputKeep,
+		keepDays:     commandConfig.OutputKeepDays,
+		filePath:     filePath,
+		params:       params,
+	}
+}
+
+// runLog is a file that keeps the output of a run. The output of all the steps goes to one file.
+type runLog struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// openRunLog creates the output file of a run, points latest to it and removes old files.
+// Returns nil if the output is not kept.
+func openRunLog(options runLogOptions) (*runLog, error) {
+	if options.dir == "" {
+		return nil, nil
+	}
+	err := os.MkdirAll(options.dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	// {{key}} and the time of the run in addition to the parameters of the command
+	params := map[string]interface{}{}
+	for k, v := range options.params {
+		params[k] = v
+	}
+	for k, v := range makeCommonLogParams("") {
+		params[k] = v
+	}
+	delete(params, "command")
+	params["key"] = options.key
+	name, err := render(options.fileTemplate, options.filePath, params)
+	if err != nil {
+		return nil, err
+	}
+	// Every file of a command is in the same directory
+	name = strings.NewReplacer("/", "_", `\`, "_").Replace(name)
+	if name == "" || name == latestLink {
+		name = latestLink + ".log"
+	}
+
+	file, err := os.OpenFile(filepath.Join(options.dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	linkLatest(options.dir, name)
+	pruneRunLogs(options.dir, name, options.keep, options.keepDays)
+	logger.Info("Output: %s", file.Name())
+	return &runLog{file: file}, nil
+}
+
+func (l *runLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Write(p)
+}
+
+// start writes the header of a command.
+func (l *runLog) start(commandString string) {
+	if l == nil {
+		return
+	}
+	fmt.Fprintf(l, "$ %s\n", commandString)
+}
+
+// end writes the result of a command.
+func (l *runLog) end(cmdResult CmdResult) {
+	if l == nil {
+		return
+	}
+	elapsed := cmdResult.EndTime.Sub(cmdResult.StartTime).Milliseconds()
+	fmt.Fprintf(l, "# exit code: %d (%dms)\n", cmdResult.ExitCode, elapsed)
+}
+
+func (l *runLog) close() {
+	if l == nil {
+		return
+	}
+	l.file.Close()
+}
+
+// linkLatest points latest to name. The link is replaced atomically.
+func linkLatest(dir string, name string) {
+	link := filepath.Join(dir, latestLink)
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	err := os.Symlink(name, tmp)
+	if err == nil {
+		err = os.Rename(tmp, link)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		logger.Info("Failed to link %s: %v", link, err)
+	}
+}
+
+// pruneRunLogs removes files over keep, and files older than keepDays. current is never removed.
+func pruneRunLogs(dir string, current string, keep int, keepDays int) {
+	if keep <= 0 && keepDays <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type logFile struct {
+		name    string
+		modTime time.Time
+	}
+	var files []logFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() || e.Name() == current {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, logFile{name: e.Name(), modTime: info.ModTime()})
+	}
+	// Newest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+
+	deadline := time.Now().AddDate(0, 0, -keepDays)
+	for i, f := range files {
+		// The current file is counted first
+		overCount := keep > 0 && i+1 >= keep
+		tooOld := keepDays > 0 && f.modTime.Before(deadline)
+		if overCount || tooOld {
+			logger.Debug("Remove: %s", f.name)
+			os.Remove(filepath.Join(dir, f.name))
+		}
+	}
+}
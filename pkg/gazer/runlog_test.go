@@ -0,0 +1,137 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtetsu/gaze/pkg/config"
+)
+
+func TestOpenRunLog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	dir, err := os.MkdirTemp("", "_gaze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	commandConfig := &config.Command{Cmd: `python "{{file}}"`, OutputDir: dir, OutputFile: "{{key}}-{{base0}}-{{name}}.log"}
+	options := newRunLogOptions(commandConfig, "src/a.py", map[string]interface{}{"name": "test"})
+	runLog, err := openRunLog(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLog.start("python src/a.py")
+	runLog.Write([]byte("hello\n"))
+	runLog.end(CmdResult{ExitCode: 1})
+	runLog.close()
+
+	key := commandConfig.Key()
+	b, err := os.ReadFile(filepath.Join(dir, key, key+"-a-test.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "$ python src/a.py\nhello\n# exit code: 1 (0ms)\n" {
+		t.Fatalf("%q", string(b))
+	}
+	link, err := os.Readlink(filepath.Join(dir, key, latestLink))
+	if err != nil || link != key+"-a-test.log" {
+		t.Fatal(link, err)
+	}
+
+	runLog, err = openRunLog(runLogOptions{})
+	if runLog != nil || err != nil {
+		t.Fatal()
+	}
+	runLog.start("ls")
+	runLog.end(CmdResult{})
+	runLog.close()
+}
+
+func TestPruneRunLogs(t *testing.T) {
+	dir, err := os.MkdirTemp("", "_gaze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for i, name := range []string{"1.log", "2.log", "3.log", "4.log", "5.log"} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(name), 0o644)
+		// 1.log is the oldest (almost 5 days ago)
+		mtime := now.AddDate(0, 0, i-5).Add(time.Hour)
+		os.Chtimes(path, mtime, mtime)
+	}
+	list := func() string {
+		entries, _ := os.ReadDir(dir)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return strings.Join(names, ",")
+	}
+
+	pruneRunLogs(dir, "5.log", 0, 0)
+	if list() != "1.log,2.log,3.log,4.log,5.log" {
+		t.Fatal(list())
+	}
+	pruneRunLogs(dir, "5.log", 0, 4)
+	if list() != "2.log,3.log,4.log,5.log" {
+		t.Fatal(list())
+	}
+	// The current file is always kept even if it is older than the others
+	pruneRunLogs(dir, "2.log", 2, 0)
+	if list() != "2.log,5.log" {
+		t.Fatal(list())
+	}
+}
+
+func TestInvokeWithOutputDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+	dir, err := os.MkdirTemp("", "_gaze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gazer, _ := New([]string{}, 100)
+	defer gazer.Close()
+
+	commandConfig := &config.Command{
+		Ext:        []string{".py"},
+		Cmd:        "python -c \"import sys; print('out'); sys.stderr.write('err'+chr(10))\"\npython -c \"print(2)\"",
+		OutputDir:  dir,
+		OutputFile: config.DefaultOutputFile,
+	}
+	inv := prepareInvocation(commandConfig, "a.py", 10*1000, false)
+	gazer.invoke(inv, nil)
+
+	b, err := os.ReadFile(filepath.Join(dir, commandConfig.Key(), latestLink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(b), "\n")
+	if len(lines) != 8 ||
+		!strings.HasPrefix(lines[0], "$ python -c") ||
+		// Stdout and stderr are different pipes, so their order is not fixed
+		(lines[1]+lines[2] != "outerr" && lines[1]+lines[2] != "errout") ||
+		!strings.HasPrefix(lines[3], "# exit code: 0 (") ||
+		lines[4] != `$ python -c "print(2)"` || lines[5] != "2" {
+		t.Fatalf("%q", string(b))
+	}
+}
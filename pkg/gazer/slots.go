@@ -0,0 +1,76 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"sync"
+
+	"github.com/wtetsu/gaze/pkg/logger"
+)
+
+// slots limits the number of commands running at the same time.
+// Commands over the limit wait in first-come, first-served order.
+type slots struct {
+	name    string
+	limit   int // 0: unlimited
+	running int
+	waiters []chan struct{}
+	mutex   sync.Mutex
+}
+
+func newSlots(name string, limit int) *slots {
+	return &slots{name: name, limit: limit}
+}
+
+// acquire waits for a free slot. Returns false if cancel is closed before a slot is given.
+func (s *slots) acquire(key string, cancel <-chan struct{}) bool {
+	s.mutex.Lock()
+	if s.limit <= 0 || (s.running < s.limit && len(s.waiters) == 0) {
+		s.running++
+		s.mutex.Unlock()
+		return true
+	}
+	waiter := make(chan struct{})
+	s.waiters = append(s.waiters, waiter)
+	logger.Info("Waiting for %s (%d running, %d waiting): %s", s.name, s.running, len(s.waiters), key)
+	s.mutex.Unlock()
+
+	select {
+	case <-waiter:
+		return true
+	case <-cancel:
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, w := range s.waiters {
+		if w == waiter {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return false
+		}
+	}
+	// The slot was given at the same time. Pass it to the next one.
+	s.releaseLocked()
+	return false
+}
+
+// release frees a slot. The slot is handed over to the oldest waiter if any.
+func (s *slots) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.releaseLocked()
+}
+
+func (s *slots) releaseLocked() {
+	if len(s.waiters) > 0 {
+		waiter := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		close(waiter)
+		return
+	}
+	s.running--
+}
@@ -0,0 +1,96 @@
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlotsUnlimited(t *testing.T) {
+	s := newSlots("a slot", 0)
+	for i := 0; i < 100; i++ {
+		if !s.acquire("key", nil) {
+			t.Fatal()
+		}
+	}
+}
+
+func TestSlotsFairness(t *testing.T) {
+	s := newSlots("a slot", 1)
+	if !s.acquire("key0", nil) {
+		t.Fatal()
+	}
+
+	order := make(chan int, 3)
+	for i := 1; i <= 3; i++ {
+		go func(i int) {
+			s.acquire("key", nil)
+			order <- i
+			s.release()
+		}(i)
+		// Make sure they wait in order
+		waitForWaiters(t, s, i)
+	}
+	if len(order) != 0 {
+		t.Fatal("should wait for a slot")
+	}
+
+	s.release()
+	for i := 1; i <= 3; i++ {
+		select {
+		case got := <-order:
+			if got != i {
+				t.Fatalf("expected %d but got %d", i, got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("not acquired")
+		}
+	}
+	// The last one releases its slot after sending its order
+	waitFor(t, func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return s.running == 0 && len(s.waiters) == 0
+	})
+}
+
+// waitForWaiters waits until n acquirers are waiting for a slot.
+func waitForWaiters(t *testing.T, s *slots, n int) {
+	t.Helper()
+	waitFor(t, func() bool {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return len(s.waiters) == n
+	})
+}
+
+func TestSlotsCancel(t *testing.T) {
+	s := newSlots("a slot", 1)
+	s.acquire("key0", nil)
+
+	cancel := make(chan struct{})
+	result := make(chan bool)
+	go func() {
+		result <- s.acquire("key1", cancel)
+	}()
+	waitForWaiters(t, s, 1)
+	close(cancel)
+
+	if <-result {
+		t.Fatal()
+	}
+	waitForWaiters(t, s, 0)
+
+	s.release()
+	if !s.acquire("key2", nil) {
+		t.Fatal()
+	}
+	if s.running != 1 {
+		t.Fatal(s.running)
+	}
+}
@@ -9,19 +9,204 @@ package gazer
 import (
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/cbroglie/mustache"
 )
 
 var templateCache = make(map[string]*mustache.Template)
 
-func render(sourceString string, rawfilePath string) (string, error) {
+// Templates are rendered by the main loop and by running commands (output_file)
+var templateCacheMutex sync.Mutex
+
+// render renders a command template. extraParams are added to the parameters derived from the file path.
+func render(sourceString string, rawfilePath string, extraParams map[string]interface{}) (string, error) {
+	template, err := getOrCreateTemplate(sourceString)
+	if err != nil {
+		return "", err
+	}
+	return template.Render(templateValues(rawfilePath, extraParams))
+}
+
+// renderForShell renders a command template run by a shell.
+// Each value is quoted according to where it appears: unquoted, in "..." or in '...',
+// including inside $(...) and `...`.
+func renderForShell(sourceString string, rawfilePath string, extraParams map[string]interface{}) (string, error) {
 	template, err := getOrCreateTemplate(sourceString)
 	if err != nil {
 		return "", err
 	}
 
+	var values []shellValue
+	placeholder := func(value shellValue) string {
+		values = append(values, value)
+		return "\x00" + strconv.Itoa(len(values)-1) + "\x00"
+	}
+	params := templateValues(rawfilePath, extraParams)
+	for k, v := range params {
+		if k == "count" {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			params[k] = placeholder(shellValue{value: v})
+		case fileList:
+			params[k] = placeholder(shellValue{files: v})
+		case map[string]string:
+			m := make(map[string]string, len(v))
+			for kk, vv := range v {
+				m[kk] = placeholder(shellValue{value: vv})
+			}
+			params[k] = m
+		}
+	}
+
+	result, err := template.Render(params)
+	if err != nil {
+		return "", err
+	}
+	return replacePlaceholders(result, values), nil
+}
+
+// shellValue is a value placed in a shell command. files is set for {{files}}.
+type shellValue struct {
+	value string
+	files fileList
+}
+
+// quote quotes the value for the quote surrounding it.
+// Unquoted files are separate words. In quotes, they are one string separated by spaces.
+func (v shellValue) quote(quote byte) string {
+	if v.files == nil {
+		return quoteShell(v.value, quote)
+	}
+	if quote == 0 {
+		return v.files.String()
+	}
+	paths := make([]string, len(v.files))
+	for i, f := range v.files {
+		paths[i] = filepath.ToSlash(f)
+	}
+	return quoteShell(strings.Join(paths, " "), quote)
+}
+
+// shellFrame is a level of a shell command: the top level, $(...) or `...`.
+type shellFrame struct {
+	closer byte // ')' or '`'. 0 at the top level
+	parens int  // Unclosed "(" in the frame
+	quote  byte // 0, ' or "
+}
+
+// replacePlaceholders replaces placeholders with values quoted for the shell.
+// It follows the quotes and command substitutions of the command to know how each value should be quoted.
+func replacePlaceholders(commandString string, values []shellValue) string {
+	var b strings.Builder
+	frames := []*shellFrame{{}}
+	push := func(closer byte) {
+		frames = append(frames, &shellFrame{closer: closer})
+	}
+	pop := func() {
+		if len(frames) > 1 {
+			frames = frames[:len(frames)-1]
+		}
+	}
+	escaped := false
+	for i := 0; i < len(commandString); i++ {
+		c := commandString[i]
+		f := frames[len(frames)-1]
+		if c == 0 {
+			end := strings.IndexByte(commandString[i+1:], 0)
+			index, _ := strconv.Atoi(commandString[i+1 : i+1+end])
+			b.WriteString(quoteInFrames(values[index], frames))
+			i += end + 1
+			escaped = false
+			continue
+		}
+		b.WriteByte(c)
+		if escaped {
+			escaped = false
+			continue
+		}
+		if f.quote == '\'' {
+			if c == '\'' {
+				f.quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = true
+		case '"':
+			if f.quote == 0 {
+				f.quote = c
+			} else {
+				f.quote = 0
+			}
+		case '\'':
+			if f.quote == 0 {
+				f.quote = c
+			}
+		case '$':
+			if i+1 < len(commandString) && commandString[i+1] == '(' {
+				b.WriteByte('(')
+				i++
+				push(')')
+			}
+		case '`':
+			if f.closer == '`' {
+				pop()
+			} else {
+				push('`')
+			}
+		case '(':
+			if f.quote == 0 {
+				f.parens++
+			}
+		case ')':
+			if f.quote != 0 {
+				break
+			}
+			if f.parens > 0 {
+				f.parens--
+			} else if f.closer == ')' {
+				pop()
+			}
+		}
+	}
+	return b.String()
+}
+
+// quoteInFrames quotes a value for the innermost frame.
+// Backslashes and backquotes are escaped again for each `...` since the shell unescapes them before running it.
+func quoteInFrames(value shellValue, frames []*shellFrame) string {
+	quoted := value.quote(frames[len(frames)-1].quote)
+	for _, f := range frames {
+		if f.closer == '`' {
+			quoted = backquoteEscaper.Replace(quoted)
+		}
+	}
+	return quoted
+}
+
+var backquoteEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+
+// quoteShell quotes a value to be placed in a shell command. quote is the quote surrounding the value.
+func quoteShell(value string, quote byte) string {
+	switch quote {
+	case '\'':
+		return strings.ReplaceAll(value, "'", `'\''`)
+	case '"':
+		return doubleQuoteEscaper.Replace(value)
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+var doubleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+// templateValues returns the parameters of a template.
+func templateValues(rawfilePath string, extraParams map[string]interface{}) map[string]interface{} {
 	filePath := filepath.ToSlash(rawfilePath)
 	ext := filepath.Ext(filePath)
 	base := filepath.Base(filePath)
@@ -34,7 +219,7 @@ func render(sourceString string, rawfilePath string) (string, error) {
 	base1 := baseN(arr, 1)
 	base2 := baseN(arr, 2)
 
-	params := map[string]string{
+	params := map[string]interface{}{
 		"file":  filePath,
 		"ext":   ext,
 		"base":  base,
@@ -43,14 +228,19 @@ func render(sourceString string, rawfilePath string) (string, error) {
 		"base0": base0,
 		"base1": base1,
 		"base2": base2,
+		"files": fileList{filePath},
+		"count": "1",
 	}
-
-	result, err := template.Render(params)
-
-	return result, err
+	for k, v := range extraParams {
+		params[k] = v
+	}
+	return params
 }
 
 func getOrCreateTemplate(sourceString string) (*mustache.Template, error) {
+	templateCacheMutex.Lock()
+	defer templateCacheMutex.Unlock()
+
 	cachedTemplate, ok := templateCache[sourceString]
 	if ok {
 		return cachedTemplate, nil
@@ -74,3 +264,19 @@ func baseN(arr []string, lastIndex int) string {
 	}
 	return strings.Join(list, ".")
 }
+
+// fileList is the value of {{files}}. It is rendered as quoted paths separated by spaces.
+type fileList []string
+
+func (l fileList) String() string {
+	return joinQuoted(l)
+}
+
+// joinQuoted quotes each file path for the shell and joins them with spaces
+func joinQuoted(files []string) string {
+	quoted := make([]string, len(files))
+	for i, f := range files {
+		quoted[i] = quoteShell(filepath.ToSlash(f), 0)
+	}
+	return strings.Join(quoted, " ")
+}
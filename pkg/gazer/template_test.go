@@ -11,7 +11,7 @@ import (
 )
 
 func TestTemplate1(t *testing.T) {
-	r, err := render("{{file}} {{ext}} {{base}} {{dir}} {{base0}} {{base1}} {{base2}}", "/full/path/test.txt.bak")
+	r, err := render("{{file}} {{ext}} {{base}} {{dir}} {{base0}} {{base1}} {{base2}}", "/full/path/test.txt.bak", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -22,8 +22,65 @@ func TestTemplate1(t *testing.T) {
 }
 
 func TestTemplateError(t *testing.T) {
-	r, err := render("{{file}", "/full/path/test.txt.bak")
+	r, err := render("{{file}", "/full/path/test.txt.bak", nil)
 	if err == nil || r != "" {
 		t.Fatal(err)
 	}
 }
+
+func TestTemplateExtraParams(t *testing.T) {
+	extra := map[string]interface{}{"re": map[string]string{"0": "services/api/", "1": "api", "svc": "api"}}
+	r, err := render("make -C services/{{re.svc}} {{re.1}} {{re.2}}{{base0}}", "services/api/main.go", extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != "make -C services/api api main" {
+		t.Fatal(r)
+	}
+}
+
+func TestTemplateForShell(t *testing.T) {
+	filePath := `/tmp/a b/it's $(rm -rf x)"`
+	testCases := []struct {
+		source   string
+		expected string
+	}{
+		{`cat {{file}}`, `cat '/tmp/a b/it'\''s $(rm -rf x)"'`},
+		{`cat "{{file}}"`, `cat "/tmp/a b/it's \$(rm -rf x)\""`},
+		{`cat '{{file}}'`, `cat '/tmp/a b/it'\''s $(rm -rf x)"'`},
+		{`echo "'" {{base}} \" {{ext}}`, `echo "'" 'it'\''s $(rm -rf x)"' \" ''`},
+		{`cat {{files}} | wc -l > "{{dir}}/n.txt"`, `cat '/tmp/a b/it'\''s $(rm -rf x)"' | wc -l > "/tmp/a b/n.txt"`},
+	}
+	for _, tc := range testCases {
+		r, err := renderForShell(tc.source, filePath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != tc.expected {
+			t.Fatalf("%s: %s", tc.source, r)
+		}
+	}
+
+	extra := map[string]interface{}{"re": map[string]string{"1": "a;b"}}
+	r, _ := renderForShell(`make {{re.1}}`, "a.go", extra)
+	if r != `make 'a;b'` {
+		t.Fatal(r)
+	}
+
+	// Quotes start over inside command substitutions
+	r, _ = renderForShell(`echo "$(cat '{{file}}')"`, `x';id;'.py`, nil)
+	if r != `echo "$(cat 'x'\'';id;'\''.py')"` {
+		t.Fatal(r)
+	}
+	r, _ = renderForShell("echo \"`cat {{file}}`\"", "a`id`.py", nil)
+	if r != "echo \"`cat 'a\\`id\\`.py'`\"" {
+		t.Fatal(r)
+	}
+
+	// {{files}} in quotes is one string
+	files := map[string]interface{}{"files": fileList{"a b.py", "c.py"}}
+	r, _ = renderForShell(`echo "{{files}}" '{{files}}' {{files}}`, "a b.py", files)
+	if r != `echo "a b.py c.py" 'a b.py c.py' 'a b.py' 'c.py'` {
+		t.Fatal(r)
+	}
+}
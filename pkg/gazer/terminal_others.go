@@ -0,0 +1,33 @@
+//go:build !linux && !darwin
+
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import "errors"
+
+type terminal struct{}
+
+func openTerminal() (*terminal, error) {
+	return nil, errors.New("keys are not supported on this platform")
+}
+
+func (t *terminal) keyMode() error {
+	return nil
+}
+
+func (t *terminal) restore() error {
+	return nil
+}
+
+func (t *terminal) read(buf []byte) (int, error) {
+	return 0, nil
+}
+
+func terminalWidth() int {
+	return defaultTerminalWidth
+}
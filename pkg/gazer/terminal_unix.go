@@ -0,0 +1,69 @@
+//go:build linux || darwin
+
+/**
+ * Gaze (https://github.com/wtetsu/gaze/)
+ * Copyright 2020-present wtetsu
+ * Licensed under MIT
+ */
+
+package gazer
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// terminal switches stdin between the normal mode and the key mode.
+type terminal struct {
+	fd       int
+	original unix.Termios
+}
+
+// openTerminal returns an error if stdin is not a terminal or Gaze runs in the background.
+func openTerminal() (*terminal, error) {
+	fd := int(os.Stdin.Fd())
+	termios, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, errors.New("stdin is not a terminal")
+	}
+	// Changing the mode from the background stops Gaze with SIGTTOU
+	foreground, err := unix.IoctlGetInt(fd, unix.TIOCGPGRP)
+	if err != nil || foreground != unix.Getpgrp() {
+		return nil, errors.New("not in the foreground")
+	}
+	return &terminal{fd: fd, original: *termios}, nil
+}
+
+// keyMode reads each key without Enter and echo.
+// Output processing and signals such as Ctrl+C work as usual. A read returns after 100ms without input.
+func (t *terminal) keyMode() error {
+	termios := t.original
+	termios.Lflag &^= unix.ICANON | unix.ECHO
+	termios.Cc[unix.VMIN] = 0
+	termios.Cc[unix.VTIME] = 1
+	return unix.IoctlSetTermios(t.fd, ioctlSetTermios, &termios)
+}
+
+// restore goes back to the original mode.
+func (t *terminal) restore() error {
+	return unix.IoctlSetTermios(t.fd, ioctlSetTermios, &t.original)
+}
+
+func (t *terminal) read(buf []byte) (int, error) {
+	n, err := unix.Read(t.fd, buf)
+	if errors.Is(err, unix.EINTR) || errors.Is(err, unix.EAGAIN) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// terminalWidth returns the width of the terminal. 80 if it is unknown.
+func terminalWidth() int {
+	ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ)
+	if err != nil || ws.Col == 0 {
+		return defaultTerminalWidth
+	}
+	return int(ws.Col)
+}
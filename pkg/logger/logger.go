@@ -32,6 +32,13 @@ var printDebug func(format string, a ...interface{})
 var printError func(format string, a ...interface{})
 
 var initialized = false
+var colorful = false
+
+// Colors of labels
+var labelColors = []color.Attribute{
+	color.FgGreen, color.FgYellow, color.FgBlue, color.FgMagenta,
+	color.FgHiGreen, color.FgHiYellow, color.FgHiBlue, color.FgHiMagenta,
+}
 
 var mutex = &sync.Mutex{}
 
@@ -57,6 +64,7 @@ func Colorful() {
 	printError = func(format string, a ...interface{}) {
 		f(color.Error, format, a...)
 	}
+	colorful = true
 	initialized = true
 }
 
@@ -71,6 +79,7 @@ func Plain() {
 	printError = func(format string, a ...interface{}) {
 		fmt.Fprintf(os.Stderr, format, a...)
 	}
+	colorful = false
 	initialized = true
 }
 
@@ -163,3 +172,14 @@ func newLine() {
 	}
 	fmt.Println()
 }
+
+// Label returns a label colored by n. The same n has the same color. The label is not colored in the plain mode.
+func Label(label string, n int) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	initialize()
+	if !colorful {
+		return label
+	}
+	return color.New(labelColors[n%len(labelColors)]).Sprint(label)
+}
@@ -44,3 +44,14 @@ func writeAll() {
 	Debug("log(Debug)")
 	DebugObject("log(DebugObject)")
 }
+
+func TestLabel(t *testing.T) {
+	Plain()
+	if Label("a.py", 1) != "a.py" {
+		t.Fatal()
+	}
+	Colorful()
+	Label("a.py", 1)
+	Label("a.py", len(labelColors)+1)
+	Plain()
+}